@@ -0,0 +1,33 @@
+package firehosePool
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// aggregateHeader is the length prefix of every record with Aggregate
+const aggregateHeader = 4
+
+// ErrBadAggregate is returned by Deaggregate when the data is not a valid
+// aggregated Firehose record
+var ErrBadAggregate = errors.New("firehose aggregated record truncated")
+
+// Deaggregate splits a Firehose record sent with Aggregate in the original
+// records. Every record is prefixed with its length as a 4 bytes big-endian
+// unsigned integer, there is nothing between them.
+func Deaggregate(b []byte) ([][]byte, error) {
+	var records [][]byte
+	for len(b) > 0 {
+		if len(b) < aggregateHeader {
+			return records, ErrBadAggregate
+		}
+		n := binary.BigEndian.Uint32(b)
+		b = b[aggregateHeader:]
+		if uint64(n) > uint64(len(b)) {
+			return records, ErrBadAggregate
+		}
+		records = append(records, b[:n])
+		b = b[n:]
+	}
+	return records, nil
+}
@@ -0,0 +1,50 @@
+package firehosePool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestAggregate(t *testing.T) {
+	srv := newTestServer(2)
+	srv.cfg.FlushInterval = time.Minute
+	srv.cfg.FlushSize = maxBatchSize
+	srv.cfg.MaxRecords = maxBatchRecords
+	srv.cfg.FlushTimeout = time.Second
+	srv.cfg.Aggregate = true
+
+	var records [][]byte
+	srv.awsSvc = &fakeAPI{put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+		for _, r := range in.Records {
+			records = append(records, r.Data)
+		}
+		return &firehose.PutRecordBatchOutput{
+			FailedPutCount:   aws.Int32(0),
+			RequestResponses: make([]types.PutRecordBatchResponseEntry, len(in.Records)),
+		}, nil
+	}}
+	clt := NewClient(srv)
+
+	srv.C <- []byte("first\nline")
+	srv.C <- []byte("second")
+	for len(srv.C) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clt.Exit()
+
+	if len(records) != 1 {
+		t.Fatalf("expected 1 aggregated record, got %d", len(records))
+	}
+	parts, err := Deaggregate(records[0])
+	if err != nil || len(parts) != 2 || string(parts[0]) != "first\nline" || string(parts[1]) != "second" {
+		t.Errorf("unexpected records %q: %v", parts, err)
+	}
+
+	if _, err := Deaggregate(records[0][:len(records[0])-1]); err != ErrBadAggregate {
+		t.Errorf("expected %s, got %v", ErrBadAggregate, err)
+	}
+}
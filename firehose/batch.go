@@ -0,0 +1,133 @@
+package firehosePool
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// BatchResult is the result of SendBatch, Records has an entry for every
+// record in the same order
+type BatchResult struct {
+	Records []RecordResult
+	Failed  int // Records rejected by Firehose
+}
+
+// RecordResult is the result of one record of SendBatch, ErrorCode is empty
+// if Firehose accepted it
+type RecordResult struct {
+	RecordID     string
+	ErrorCode    string
+	ErrorMessage string
+}
+
+// SendBatch sends the records with as many PutRecordBatch calls as needed,
+// without the buffer, and returns what Firehose replied for every record.
+// They are compressed and framed like with SendNow and they are not
+// retried. If a call fails the result has the records of the previous
+// calls and the error is returned, a connection error counts in the errors
+// of the pool.
+func (srv *Server) SendBatch(ctx context.Context, records [][]byte) (*BatchResult, error) {
+	if srv.isExiting() {
+		return nil, ErrExiting
+	}
+
+	data := make([][]byte, len(records))
+	for i, r := range records {
+		b, err := srv.encode(r)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		data[i] = b
+	}
+
+	srv.Lock()
+	api, stream := srv.awsSvc, srv.cfg.StreamName
+	srv.Unlock()
+
+	if srv.Paused() {
+		return nil, ErrPaused
+	}
+	if api == nil && !srv.conf().DryRun {
+		return nil, ErrNotConnected
+	}
+
+	result := &BatchResult{Records: make([]RecordResult, 0, len(data))}
+	for first := 0; first < len(data); {
+		// Up to the PutRecordBatch limits
+		last, size := first, 0
+		for last < len(data) && last-first < maxBatchRecords && (last == first || size+len(data[last]) <= maxBatchSize) {
+			size += len(data[last])
+			last++
+		}
+
+		output, err := srv.putBatchNow(ctx, api, stream, data[first:last])
+		if err != nil {
+			return result, err
+		}
+		for i, r := range output.RequestResponses {
+			if r.ErrorCode != nil {
+				result.Failed++
+				atomic.AddInt64(&srv.stats.RecordsFailed, 1)
+			} else {
+				atomic.AddInt64(&srv.stats.RecordsSent, 1)
+				atomic.AddInt64(&srv.stats.BytesSent, int64(len(data[first+i])))
+			}
+			result.Records = append(result.Records, RecordResult{
+				RecordID:     aws.ToString(r.RecordId),
+				ErrorCode:    aws.ToString(r.ErrorCode),
+				ErrorMessage: aws.ToString(r.ErrorMessage),
+			})
+		}
+		first = last
+	}
+	return result, nil
+}
+
+// putBatchNow does one PutRecordBatch call of SendBatch
+func (srv *Server) putBatchNow(ctx context.Context, api API, stream string, data [][]byte) (*firehose.PutRecordBatchOutput, error) {
+	records := make([]types.Record, len(data))
+	for i, b := range data {
+		records[i] = types.Record{Data: b}
+	}
+
+	if err := srv.limit(ctx, len(records)); err != nil {
+		return nil, err
+	}
+
+	if srv.conf().DryRun {
+		srv.logf(LogDebug, "Firehose DRY RUN: PutRecordBatch of %d records", len(records))
+		return &firehose.PutRecordBatchOutput{
+			FailedPutCount:   aws.Int32(0),
+			RequestResponses: make([]types.PutRecordBatchResponseEntry, len(records)),
+		}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, srv.conf().BatchTimeout)
+	defer cancel()
+
+	start := time.Now()
+	output, err := api.PutRecordBatch(ctx, &firehose.PutRecordBatchInput{
+		DeliveryStreamName: aws.String(stream),
+		Records:            records,
+	}, srv.conf().RequestOptions...)
+	srv.latency.observe(latencyBounds, int64(time.Since(start)))
+	if err != nil {
+		err = classifyBatchError(err)
+		if srv.conf().OnFHError != nil {
+			srv.conf().OnFHError(err)
+		}
+		atomic.AddInt64(&srv.stats.BatchesFailed, 1)
+		srv.logf(LogError, "Firehose ERROR PutRecordBatch: %s", err)
+		if isConnectionError(err) {
+			srv.failure(err)
+		}
+		return nil, err
+	}
+	return output, nil
+}
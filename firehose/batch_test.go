@@ -0,0 +1,71 @@
+package firehosePool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestSendBatch(t *testing.T) {
+	failed := errors.New("failed")
+	fake := &fakeAPI{put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+		out := &firehose.PutRecordBatchOutput{FailedPutCount: aws.Int32(0)}
+		for _, r := range in.Records {
+			switch string(r.Data) {
+			case "error\n":
+				return nil, failed
+			case "bad\n":
+				*out.FailedPutCount++
+				out.RequestResponses = append(out.RequestResponses, types.PutRecordBatchResponseEntry{
+					ErrorCode: aws.String(firehoseError), ErrorMessage: aws.String("rejected"),
+				})
+			default:
+				out.RequestResponses = append(out.RequestResponses, types.PutRecordBatchResponseEntry{RecordId: aws.String(string(r.Data))})
+			}
+		}
+		return out, nil
+	}}
+	srv := newTestServer(1)
+	srv.cfg.BatchTimeout = time.Second
+	srv.cfg.MaxErrors = 10
+	srv.awsSvc = fake
+
+	// Over maxBatchRecords it's split in two calls
+	records := make([][]byte, maxBatchRecords+1)
+	for i := range records {
+		records[i] = []byte("ok")
+	}
+	records[1] = []byte("bad")
+	result, err := srv.SendBatch(context.Background(), records)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fake.calls != 2 || len(result.Records) != len(records) || result.Failed != 1 {
+		t.Fatalf("expected 2 calls and 1 of %d records failed, got %d calls and %d of %d", len(records), fake.calls, result.Failed, len(result.Records))
+	}
+	if r := result.Records[0]; r.RecordID != "ok\n" || r.ErrorCode != "" {
+		t.Errorf("expected the first record accepted, got %+v", r)
+	}
+	if r := result.Records[1]; r.ErrorCode != firehoseError || r.ErrorMessage != "rejected" {
+		t.Errorf("expected the second record rejected, got %+v", r)
+	}
+	if s := srv.Stats(); s.RecordsSent != int64(len(records)-1) || s.RecordsFailed != 1 {
+		t.Errorf("expected %d records sent and 1 failed, got %d and %d", len(records)-1, s.RecordsSent, s.RecordsFailed)
+	}
+
+	records[maxBatchRecords] = []byte("error")
+	result, err = srv.SendBatch(context.Background(), records)
+	if err != failed || len(result.Records) != maxBatchRecords {
+		t.Errorf("expected the error and the records of the first call, got %v and %d", err, len(result.Records))
+	}
+
+	srv.cfg.MaxRecordSize = 4
+	if _, err := srv.SendBatch(context.Background(), [][]byte{[]byte("long")}); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("expected %s, got %v", ErrRecordTooLarge, err)
+	}
+}
@@ -0,0 +1,47 @@
+package firehosePool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"testing"
+)
+
+func BenchmarkSend(b *testing.B) {
+	record := []byte(`{"message":"benchmark record"}`)
+
+	for _, producers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("producers=%d", producers), func(b *testing.B) {
+			srv, err := Connect(context.Background(), Config{
+				StreamName: "bench",
+				MinWorkers: 4,
+				MaxWorkers: 4,
+				DryRun:     true,
+				Logger:     log.New(io.Discard, "", 0),
+			})
+			if err != nil {
+				b.Fatalf("connect: %s", err)
+			}
+			defer srv.Close()
+
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for p := 0; p < producers; p++ {
+				n := b.N / producers
+				if p == 0 {
+					n += b.N % producers
+				}
+				wg.Add(1)
+				go func(n int) {
+					defer wg.Done()
+					for i := 0; i < n; i++ {
+						srv.SendWithContext(context.Background(), record)
+					}
+				}(n)
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package firehosePool
+
+import (
+	"context"
+	"sync"
+)
+
+// Checkpointer sends records to the pool and reports, in order, the tokens
+// given to Mark once all the records sent before them were accepted by
+// Firehose or discarded. It's meant to commit the position of the source of
+// the records, e.g. Kafka offsets, only when they are in the stream.
+type Checkpointer struct {
+	sync.Mutex
+	srv         *Server
+	fn          func(token interface{}, err error)
+	checkpoints []*checkpoint // Oldest first, the last one is open if it isn't marked
+}
+
+// checkpoint has the records sent between two marks
+type checkpoint struct {
+	pending int // Records not accepted or discarded yet
+	marked  bool
+	token   interface{}
+	err     error // First error of the records
+}
+
+// NewCheckpointer creates a Checkpointer for the pool, fn is called with
+// every token and the first error of the records before it, nil if all of
+// them were accepted. fn runs in the client goroutines or in Mark, with the
+// Checkpointer locked, so it must not block nor call the Checkpointer.
+func NewCheckpointer(srv *Server, fn func(token interface{}, err error)) *Checkpointer {
+	return &Checkpointer{
+		srv: srv,
+		fn:  fn,
+	}
+}
+
+// Send puts the record in the buffer of the pool like SendWithContext, it
+// belongs to the next token given to Mark
+func (c *Checkpointer) Send(ctx context.Context, record interface{}) error {
+	c.Lock()
+	s := c.open()
+	s.pending++
+	c.Unlock()
+
+	err := c.srv.SendWithCallback(ctx, record, func(err error) {
+		c.done(s, err)
+	})
+	if err != nil {
+		// The caller got the error, the record doesn't hold the token
+		c.done(s, nil)
+	}
+	return err
+}
+
+// Mark associates the token to the records sent since the previous Mark,
+// it's reported once they and the ones of the previous tokens are done
+func (c *Checkpointer) Mark(token interface{}) {
+	c.Lock()
+	defer c.Unlock()
+
+	s := c.open()
+	s.marked = true
+	s.token = token
+	c.deliver()
+}
+
+// open returns the checkpoint of the new records
+func (c *Checkpointer) open() *checkpoint {
+	if n := len(c.checkpoints); n > 0 && !c.checkpoints[n-1].marked {
+		return c.checkpoints[n-1]
+	}
+	s := &checkpoint{}
+	c.checkpoints = append(c.checkpoints, s)
+	return s
+}
+
+func (c *Checkpointer) done(s *checkpoint, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	s.pending--
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+	c.deliver()
+}
+
+// deliver reports the tokens of the oldest checkpoints that are done
+func (c *Checkpointer) deliver() {
+	for len(c.checkpoints) > 0 {
+		s := c.checkpoints[0]
+		if !s.marked || s.pending > 0 {
+			return
+		}
+		c.checkpoints[0] = nil
+		c.checkpoints = c.checkpoints[1:]
+		if c.fn != nil {
+			c.fn(s.token, s.err)
+		}
+	}
+}
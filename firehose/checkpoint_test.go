@@ -0,0 +1,61 @@
+package firehosePool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestCheckpointer(t *testing.T) {
+	srv := newTestServer(10)
+	srv.cfg.FlushInterval = time.Minute
+	srv.cfg.FlushSize = maxBatchSize
+	srv.cfg.MaxRecords = maxBatchRecords
+	srv.cfg.FlushTimeout = time.Second
+	srv.awsSvc = &fakeAPI{put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+		return &firehose.PutRecordBatchOutput{
+			FailedPutCount:   aws.Int32(0),
+			RequestResponses: make([]types.PutRecordBatchResponseEntry, len(in.Records)),
+		}, nil
+	}}
+
+	var tokens []interface{}
+	c := NewCheckpointer(srv, func(token interface{}, err error) {
+		if err != nil {
+			t.Errorf("unexpected error for %v: %s", token, err)
+		}
+		tokens = append(tokens, token)
+	})
+
+	// Without records the token is done
+	c.Mark(0)
+	if len(tokens) != 1 {
+		t.Fatalf("expected the empty token, got %v", tokens)
+	}
+
+	for i, r := range []string{"a", "b", "c"} {
+		if err := c.Send(context.Background(), []byte(r)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		c.Mark(i + 1)
+	}
+	if len(tokens) != 1 {
+		t.Fatalf("the tokens must wait for the records, got %v", tokens)
+	}
+
+	clt := NewClient(srv)
+	for len(srv.C) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clt.Exit()
+
+	c.Lock()
+	defer c.Unlock()
+	if len(tokens) != 4 || tokens[1] != 1 || tokens[2] != 2 || tokens[3] != 3 {
+		t.Errorf("expected the tokens in order, got %v", tokens)
+	}
+}
@@ -1,15 +1,24 @@
 package firehosePool
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
-	"log"
+	"fmt"
+	"math/rand"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/gallir/bytebufferpool"
 	compress "github.com/gallir/smart-relayer/redis"
 )
@@ -19,11 +28,20 @@ const (
 	maxRecordSize   = 1000 * 1000 // The maximum size of a record sent to Kinesis Firehose, before base64-encoding, is 1000 KB
 	maxBatchRecords = 500         // The PutRecordBatch operation can take up to 500 records per call or 4 MB per call, whichever is smaller. This limit cannot be changed.
 	maxBatchSize    = 3 << 20     // 4 MiB per call
+	gzipOverhead    = 1 << 10     // Room left in the record for the gzip headers and uncompressible data
 
 	partialFailureWait = 200 * time.Millisecond
 	globalFailureWait  = 500 * time.Millisecond
 	onFlyRetryLimit    = 1024 * 2
+	workerQueueSize    = 128 // Default records buffered by every client besides the shared buffer
+	maxRecordRetries   = 3   // Default times a record rejected by Firehose is sent again before dropping it
 	firehoseError      = "InternalFailure"
+	throttleError      = "ServiceUnavailableException"
+	expiredTokenError  = "ExpiredTokenException"
+	throttleWait       = 200 * time.Millisecond
+	maxThrottleWait    = 5 * time.Second
+	adaptiveFailures   = 0.1                    // Ratio of records rejected in a batch that shrinks the batches with AdaptiveFlush
+	adaptiveDelayStep  = 100 * time.Millisecond // Delay added between batches on every batch over adaptiveFailures
 )
 
 var (
@@ -33,23 +51,89 @@ var (
 
 var pool = &bytebufferpool.Pool{}
 
+// retryRecord is a record sent back to the channel after a failure, it's
+// the Firehose record as it was sent, already serialized and compressed
+type retryRecord struct {
+	b         []byte
+	attempts  int
+	bytes     int64 // Bytes accounted in the buffered limit
+	callbacks []func(error)
+	contexts  []context.Context
+}
+
+// callbackRecord is a record sent with SendWithCallback, or with the
+// context of Send when there is a BatchHook
+type callbackRecord struct {
+	record interface{}
+	fn     func(error)
+	ctx    context.Context
+}
+
+// batchRecord is a Firehose record of the batch
+type batchRecord struct {
+	buff      *bytebufferpool.ByteBuffer
+	attempts  int               // Times that it was rejected by Firehose
+	bytes     int64             // Bytes of the records it contains accounted in the buffered limit
+	callbacks []func(error)     // Callbacks of the records it contains
+	contexts  []context.Context // Contexts of the records it contains for the BatchHook
+}
+
+// done calls the callbacks of the records with the final result
+func (r batchRecord) done(err error) {
+	for _, fn := range r.callbacks {
+		fn(err)
+	}
+}
+
 // Client is the thread that connect to the remote redis server
 type Client struct {
 	sync.Mutex
 	srv         *Server
+	C           chan interface{} // Records dispatched to this client by Send
+	cLock       sync.RWMutex     // Avoid sending to C once the client is stopped
+	stopped     bool
+	api         API    // Connection of the server when the client was created
+	stream      string // Stream of the server when the client was created
 	mode        int
 	buff        *bytebufferpool.ByteBuffer
 	count       int
-	batch       []*bytebufferpool.ByteBuffer
+	pending     []func(error)     // Callbacks of the records in buff
+	pendingCtx  []context.Context // Contexts of the records in buff
+	buffBytes   int64             // Bytes of the records in buff accounted in the buffered limit
+	batch       []batchRecord
 	batchSize   int
-	records     []*firehose.Record
+	records     []types.Record
 	done        chan bool
-	flushed     chan bool
-	finish      chan bool
+	flushC      chan chan error // Flush requests, the result is sent to the channel
+	finish      chan struct{}   // Closed to stop the client
+	finishOnce  sync.Once
+	ctx         context.Context // Cancelled once Exit stops waiting, it aborts the calls and the waits, Background if nil
+	cancel      context.CancelFunc
 	ID          int64
 	t           *time.Timer
 	lastFlushed time.Time
+	oldest      time.Time // Arrival of the oldest pending record
 	onFlyRetry  int64
+	inflight    chan struct{}  // Slots of MaxInFlightBatches, nil sends the batches in this goroutine
+	dedup       *dedup         // Hashes of the last records with DedupWindow
+	sending     sync.WaitGroup // Batches in flight
+	sendErr     error          // First error of the batches in flight, reported by flushAll
+	throttles   int            // Consecutive batches throttled by Firehose
+	throttled   time.Time      // The batches wait until then after a throttling
+	adaptSize   int            // Batch size tuned by AdaptiveFlush, 0 is FlushSize
+	adaptDelay  time.Duration  // Wait before every batch tuned by AdaptiveFlush
+	stats       clientCounters // Updated with atomics, read by Server.Clients
+}
+
+// queueSize is the capacity of the buffer of a client for WorkerQueueSize
+func queueSize(size int) int {
+	switch {
+	case size == 0:
+		return workerQueueSize
+	case size < 0:
+		return 0
+	}
+	return size
 }
 
 // NewClient creates a new client that connects to a Firehose
@@ -57,262 +141,1100 @@ func NewClient(srv *Server) *Client {
 	n := atomic.AddInt64(&clientCount, 1)
 
 	clt := &Client{
-		done:    make(chan bool),
-		finish:  make(chan bool),
-		flushed: make(chan bool),
+		C:       make(chan interface{}, queueSize(srv.cfg.WorkerQueueSize)),
+		done:    make(chan bool, 1),
+		finish:  make(chan struct{}),
+		flushC:  make(chan chan error),
 		srv:     srv,
+		api:     srv.awsSvc,
+		stream:  srv.cfg.StreamName,
 		ID:      n,
-		t:       time.NewTimer(recordsTimeout),
-		batch:   make([]*bytebufferpool.ByteBuffer, 0, maxBatchRecords),
-		records: make([]*firehose.Record, 0, maxBatchRecords),
+		t:       time.NewTimer(firstFlush(srv.cfg.FlushInterval)),
+		batch:   make([]batchRecord, 0, maxBatchRecords),
+		records: make([]types.Record, 0, maxBatchRecords),
 		buff:    pool.Get(),
 	}
+	clt.ctx, clt.cancel = context.WithCancel(context.Background())
+	if srv.cfg.MaxInFlightBatches > 1 {
+		clt.inflight = make(chan struct{}, srv.cfg.MaxInFlightBatches)
+	}
+	if srv.cfg.DedupWindow > 0 {
+		clt.dedup = newDedup(srv.cfg.DedupWindow)
+	}
 
+	srv.running.Add(1)
 	go clt.listen()
 
 	return clt
 }
 
 func (clt *Client) listen() {
-	log.Printf("Firehose client %s [%d]: ready", clt.srv.cfg.StreamName, clt.ID)
+	defer clt.srv.running.Done()
+	atomic.AddInt64(&clt.srv.stats.ActiveClients, 1)
+	defer atomic.AddInt64(&clt.srv.stats.ActiveClients, -1)
+
+	clt.srv.logf(LogDebug, "Firehose client %s [%d]: ready", clt.stream, clt.ID)
 	for {
+		// A stopped client doesn't take more records
+		select {
+		case <-clt.finish:
+			clt.shutdown()
+			return
+		default:
+		}
+
+		// The records stay in the buffers while the pool is paused
+		if resumed := clt.srv.resumed(); resumed != nil && !clt.wait(resumed) {
+			clt.shutdown()
+			return
+		}
 
 		select {
-		case ri := <-clt.srv.C:
+		case ri, ok := <-clt.srv.C:
+			if !ok {
+				// The pool exited without waiting for this client
+				clt.drain()
+				clt.flushAll()
+				clt.srv.logf(LogDebug, "Firehose client %s [%d]: Exit", clt.stream, clt.ID)
+				return
+			}
 
-			var r []byte
-			if clt.srv.cfg.Serializer != nil {
-				var err error
-				if r, err = clt.srv.cfg.Serializer(ri); err != nil {
-					log.Printf("Firehose client %s [%d]: ERROR serializer: %s", clt.srv.cfg.StreamName, clt.ID, err)
-					continue
-				}
-			} else {
-				r = ri.([]byte)
+			clt.process(ri)
+		case ri := <-clt.C:
+			clt.process(ri)
+		case <-clt.t.C:
+			if clt.srv.Paused() {
+				continue // The timer is programmed again on Resume
 			}
+			clt.flush()
+			if clt.buff.Len() > 0 {
+				clt.appendBuff()
+				clt.flush()
+			}
+		case ch := <-clt.flushC:
+			clt.flushRequest(ch)
+		case <-clt.finish:
+			clt.shutdown()
+			return
+		}
+	}
+}
 
-			recordSize := len(r)
+// process adds a record taken from the buffers to the batch
+func (clt *Client) process(ri interface{}) {
+	if rr, ok := ri.(*retryRecord); ok {
+		clt.addRetry(rr)
+		return
+	}
 
-			if recordSize <= 0 {
-				continue
+	var fn func(error)
+	var ctx context.Context
+	if cr, ok := ri.(*callbackRecord); ok {
+		ri, fn, ctx = cr.record, cr.fn, cr.ctx
+	}
+
+	// Bytes accounted by Send, only for []byte records
+	var size int64
+	if b, ok := ri.([]byte); ok {
+		size = int64(len(b))
+	}
+
+	var r []byte
+	if clt.srv.conf().Serializer != nil {
+		var err error
+		if r, err = clt.srv.conf().Serializer(ri); err != nil {
+			clt.srv.logf(LogError, "Firehose client %s [%d]: ERROR serializer: %s", clt.stream, clt.ID, err)
+			clt.srv.release(size)
+			clt.srv.discard(nil, err)
+			if fn != nil {
+				fn(err)
 			}
+			return
+		}
+		if _, ok := ri.([]byte); !ok {
+			size = int64(len(r))
+			atomic.AddInt64(&clt.srv.buffered, size)
+		}
+	} else {
+		r = ri.([]byte)
+	}
 
-			if clt.srv.cfg.Compress {
-				// All the message will be compress. This will work with raw and json messages.
-				r = compress.Bytes(r)
-				// Update the record size using the compression []byte result
-				recordSize = len(r)
+	// The hash is remembered once the record is added to the batch, a
+	// record discarded before doesn't make its copies duplicates
+	var hash uint64
+	if clt.dedup != nil {
+		if hash = clt.hash(r); clt.dedup.seen(hash) {
+			atomic.AddInt64(&clt.srv.stats.RecordsDeduped, 1)
+			clt.srv.release(size)
+			if fn != nil {
+				fn(ErrDuplicate)
 			}
+			return
+		}
+	}
 
-			if recordSize > maxRecordSize {
-				log.Printf("Firehose client %s [%d]: ERROR: one record is over the limit %d/%d", clt.srv.cfg.StreamName, clt.ID, recordSize, maxRecordSize)
-				continue
+	if clt.srv.conf().Transform != nil {
+		t, err := clt.srv.conf().Transform(r)
+		if err != nil {
+			clt.srv.logf(LogError, "Firehose client %s [%d]: ERROR transform: %s", clt.stream, clt.ID, err)
+			clt.srv.discardRaw(r, err)
+			clt.srv.release(size)
+			if fn != nil {
+				fn(err)
 			}
+			return
+		}
+		r = t
+	}
 
-			clt.count++
+	recordSize := len(r)
 
-			// The PutRecordBatch operation can take up to 500 records per call or 4 MB per call, whichever is smaller. This limit cannot be changed.
-			if clt.count >= clt.srv.cfg.MaxRecords || len(clt.batch) >= maxBatchRecords || clt.batchSize+recordSize+1 >= maxBatchSize {
-				// log.Printf("flush: count %d/%d | batch %d/%d | size [%d] %d/%d",
-				// 	clt.count, clt.srv.cfg.MaxRecords, len(clt.batch), maxBatchRecords, recordSize, (clt.batchSize+recordSize+1)/1024, maxBatchSize/1024)
-				// Force flush
-				clt.flush()
-			}
+	if recordSize <= 0 {
+		// Nothing to send
+		clt.srv.release(size)
+		if fn != nil {
+			fn(nil)
+		}
+		return
+	}
 
-			// The maximum size of a record sent to Kinesis Firehose, before base64-encoding, is 1000 KB.
-			if !clt.srv.cfg.ConcatRecords || clt.buff.Len()+recordSize+1 >= maxRecordSize || clt.count >= clt.srv.cfg.MaxRecords {
-				if clt.buff.Len() > 0 {
-					// Save in new record
-					buff := clt.buff
-					clt.batch = append(clt.batch, buff)
-					clt.buff = pool.Get()
-				}
+	// Already compressed records are not compressed again nor concatenated
+	if clt.srv.conf().SkipCompressed && clt.srv.conf().Compression == CompressionGzip && isGzip(r) {
+		if len(r) > maxRecordSize {
+			clt.srv.logf(LogError, "Firehose client %s [%d]: ERROR: one record is over the limit %d/%d", clt.stream, clt.ID, len(r), maxRecordSize)
+			clt.srv.discard(r, ErrRecordTooLarge)
+			clt.srv.release(size)
+			if fn != nil {
+				fn(ErrRecordTooLarge)
 			}
+			return
+		}
+		var callbacks []func(error)
+		if fn != nil {
+			callbacks = []func(error){fn}
+		}
+		var contexts []context.Context
+		if ctx != nil {
+			contexts = []context.Context{ctx}
+		}
+		clt.addRaw(batchRecord{bytes: size, callbacks: callbacks, contexts: contexts}, r)
+		if clt.dedup != nil {
+			clt.dedup.add(hash)
+		}
+		return
+	}
 
-			clt.buff.Write(r)
-			clt.buff.Write(newLine)
+	raw := r
+	if clt.srv.conf().Compress {
+		// All the message will be compress. This will work with raw and json messages.
+		r = compress.Bytes(r)
+		// Update the record size using the compression []byte result
+		recordSize = len(r)
+	}
 
-			clt.batchSize += clt.buff.Len()
+	if clt.srv.framedLen(r) > clt.recordLimit() {
+		clt.srv.logf(LogError, "Firehose client %s [%d]: ERROR: one record is over the limit %d/%d", clt.stream, clt.ID, recordSize, clt.recordLimit())
+		clt.srv.discardRaw(raw, ErrRecordTooLarge)
+		clt.srv.release(size)
+		if fn != nil {
+			fn(ErrRecordTooLarge)
+		}
+		return
+	}
 
-			if len(clt.batch)+1 >= maxBatchRecords || clt.batchSize >= maxBatchSize {
-				clt.flush()
-			}
+	clt.count++
+	atomic.StoreInt64(&clt.stats.pending, int64(clt.count))
+
+	// Bytes added to the record by the framing
+	framing := clt.srv.framing()
+	overhead := 0
+	switch framing {
+	case FramingNewline:
+		overhead = len(newLine)
+	case FramingLengthPrefixed:
+		overhead = aggregateHeader
+	}
+
+	// The PutRecordBatch operation can take up to 500 records per call or 4 MB per call, whichever is smaller. This limit cannot be changed.
+	if clt.count >= clt.srv.conf().MaxRecords || len(clt.batch) >= maxBatchRecords || clt.batchSize+recordSize+overhead >= clt.flushSize() {
+		// log.Printf("flush: count %d/%d | batch %d/%d | size [%d] %d/%d",
+		// 	clt.count, clt.srv.conf().MaxRecords, len(clt.batch), maxBatchRecords, recordSize, (clt.batchSize+recordSize+1)/1024, maxBatchSize/1024)
+		// Force flush
+		clt.flush()
+	}
+
+	// The maximum size of a record sent to Kinesis Firehose, before base64-encoding, is 1000 KB.
+	// Without framing the records can't be split again, they aren't concatenated
+	concat := (clt.srv.conf().ConcatRecords || clt.srv.conf().Aggregate) && framing != FramingNone
+	if !concat || clt.buff.Len()+recordSize+overhead >= clt.recordLimit() || clt.count >= clt.srv.conf().MaxRecords {
+		if clt.buff.Len() > 0 {
+			// Save in new record
+			clt.appendBuff()
+		}
+	}
+
+	clt.buff.B = clt.srv.frame(clt.buff.B, r)
+	if fn != nil {
+		clt.pending = append(clt.pending, fn)
+	}
+	if ctx != nil {
+		clt.pendingCtx = append(clt.pendingCtx, ctx)
+	}
+	clt.buffBytes += size
+	if clt.dedup != nil {
+		clt.dedup.add(hash)
+	}
+
+	clt.batchSize += clt.buff.Len()
+	clt.pendingSince()
+
+	if len(clt.batch)+1 >= maxBatchRecords || clt.batchSize >= clt.flushSize() {
+		clt.flush()
+	}
+}
+
+// flushRequest sends all the records of the client for Flush
+func (clt *Client) flushRequest(ch chan error) {
+	clt.drain()
+	err := clt.flushAll()
+	if err != nil {
+		clt.srv.logf(LogWarn, "Firehose client %s [%d]: Flush failed: %s", clt.stream, clt.ID, err)
+	}
+	ch <- err
+}
 
+// shutdown sends the pending records before the client exits
+func (clt *Client) shutdown() {
+	//Stop and drain the timer channel
+	if !clt.t.Stop() {
+		select {
 		case <-clt.t.C:
+		default:
+		}
+	}
+
+	// The pool keeps running when the client is removed, the records of its
+	// buffer go to the other clients instead of waiting for this flush
+	if !clt.srv.isExiting() {
+		clt.handBack()
+	}
+	clt.drain()
+	clt.flushAll()
+
+	if l := len(clt.batch); l > 0 {
+		clt.srv.logf(LogError, "Firehose client %s [%d]: Exit, %d records lost", clt.stream, clt.ID, l)
+		for _, r := range clt.batch {
+			clt.fail(r, ErrExiting)
+		}
+		clt.done <- false // WARN: To avoid blocking the processs
+		return
+	}
+
+	clt.srv.logf(LogDebug, "Firehose client %s [%d]: Exit", clt.stream, clt.ID)
+	clt.done <- true
+}
+
+// flushAll sends the batch including the partial record in the buffer, it
+// waits for the batches in flight too
+func (clt *Client) flushAll() error {
+	// Only the batches not finished yet are reported
+	clt.Lock()
+	clt.sendErr = nil
+	clt.Unlock()
+
+	if clt.buff.Len() > 0 {
+		if len(clt.batch) >= maxBatchRecords {
 			clt.flush()
-			if clt.buff.Len() > 0 {
-				buff := clt.buff
-				clt.batch = append(clt.batch, buff)
-				clt.buff = pool.Get()
-				clt.flush()
-			}
-		case f := <-clt.finish:
-			//Stop and drain the timer channel
-			if f && !clt.t.Stop() {
-				select {
-				case <-clt.t.C:
-				default:
-				}
-			}
+		}
+		clt.appendBuff()
+	}
+	err := clt.flush()
 
-			var err error
-			if clt.buff.Len() > 0 {
-				if len(clt.batch) >= maxBatchRecords {
-					err = clt.flush()
-				}
-				clt.batch = append(clt.batch, clt.buff)
-				clt.buff = pool.Get() // Get a new pool in case is only a flush
-			}
-			err = clt.flush()
-
-			if f {
-				// Have to finish
-				if l := len(clt.batch); l > 0 {
-					log.Printf("Firehose client %s [%d]: Exit, %d records lost", clt.srv.cfg.StreamName, clt.ID, l)
-					clt.done <- false // WARN: To avoid blocking the processs
-					return
-				}
+	clt.sending.Wait()
+	clt.Lock()
+	if err == nil {
+		err = clt.sendErr
+	}
+	clt.sendErr = nil
+	clt.Unlock()
+	return err
+}
 
-				log.Printf("Firehose client %s [%d]: Exit", clt.srv.cfg.StreamName, clt.ID)
-				clt.done <- true
-				return
-			}
+// framing returns the Framing of the records, Aggregate implies the length
+// prefix and newline is the default
+func (srv *Server) framing() string {
+	switch {
+	case srv.conf().Aggregate:
+		return FramingLengthPrefixed
+	case srv.conf().Framing == "":
+		return FramingNewline
+	}
+	return srv.conf().Framing
+}
 
-			// Only a flush
-			if l := len(clt.batch); l > 0 || err != nil {
-				log.Printf("Firehose client %s [%d]: Flush, %d records pending", clt.srv.cfg.StreamName, clt.ID, l)
-				clt.flushed <- false // WARN: To avoid blocking the processs
-				return
-			}
-			clt.flushed <- true
+// frame appends the record to dst with the framing, the record itself is
+// never modified
+func (srv *Server) frame(dst, b []byte) []byte {
+	switch srv.framing() {
+	case FramingLengthPrefixed:
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(b)))
+		return append(dst, b...)
+	case FramingNone:
+		return append(dst, b...)
+	}
+
+	// Records are newline terminated, unless they already end with it.
+	// Compressed ones always are, they could end with the byte by chance.
+	dst = append(dst, b...)
+	if srv.conf().Compress || !bytes.HasSuffix(b, newLine) {
+		dst = append(dst, newLine...)
+	}
+	return dst
+}
+
+// framedLen is the size of the record in a Firehose record with the framing
+func (srv *Server) framedLen(b []byte) int {
+	switch srv.framing() {
+	case FramingLengthPrefixed:
+		return len(b) + aggregateHeader
+	case FramingNone:
+		return len(b)
+	}
+	return delimitedLen(b)
+}
+
+// delimitedLen is the size of the record once it's newline terminated
+func delimitedLen(b []byte) int {
+	if bytes.HasSuffix(b, newLine) {
+		return len(b)
+	}
+	return len(b) + len(newLine)
+}
+
+// appendBuff moves the current buffer to the batch as a new record and
+// gets a new one from the pool
+func (clt *Client) appendBuff() {
+	r := batchRecord{buff: clt.buff, bytes: clt.buffBytes, callbacks: clt.pending, contexts: clt.pendingCtx}
+	clt.buff = pool.Get()
+	clt.pending = nil
+	clt.pendingCtx = nil
+	clt.buffBytes = 0
+
+	if c := compressor(clt.srv.conf().Compression); c != nil {
+		if err := compressBuff(c, &r); err != nil {
+			clt.srv.logf(LogError, "Firehose client %s [%d]: ERROR compression %s: %s", clt.stream, clt.ID, clt.srv.conf().Compression, err)
+			clt.fail(r, err)
+			pool.Put(r.buff)
+			return
 		}
 	}
+	clt.batch = append(clt.batch, r)
 }
 
-// flush build the last record if need and send the records slice to AWS Firehose
-func (clt *Client) flush() error {
+// compressBuff replaces the buffer of the record with its compressed
+// content, it fails if the compressed record is over the Firehose limit
+func compressBuff(c Compressor, r *batchRecord) error {
+	out := pool.Get()
+	var err error
+	if out.B, err = c.Compress(out.B[:0], r.buff.B); err == nil && out.Len() > maxRecordSize {
+		err = fmt.Errorf("%w: %d bytes compressed", ErrRecordTooLarge, out.Len())
+	}
+	if err != nil {
+		pool.Put(out)
+		return err
+	}
+
+	pool.Put(r.buff)
+	r.buff = out
+	return nil
+}
+
+// recordLimit is the maximum size of the content of one Firehose record,
+// with compression it leaves room to be sure the compressed record fits in
+// the limit
+func (clt *Client) recordLimit() int {
+	limit := clt.srv.conf().MaxRecordSize
+	if c := compressor(clt.srv.conf().Compression); c != nil {
+		for over := c.MaxLen(limit) - maxRecordSize; over > 0 && limit > 0; over = c.MaxLen(limit) - maxRecordSize {
+			limit -= over
+		}
+	}
+	return limit
+}
+
+// addRetry adds a record that was already sent as a single record of the
+// batch, so the attempts are counted by record
+func (clt *Client) addRetry(rr *retryRecord) {
+	clt.addRaw(batchRecord{attempts: rr.attempts, bytes: rr.bytes, callbacks: rr.callbacks, contexts: rr.contexts}, rr.b)
+}
+
+// addRaw adds the data as a single record of the batch as it is, without
+// compression or newline
+func (clt *Client) addRaw(r batchRecord, data []byte) {
+	if len(clt.batch)+2 >= maxBatchRecords || clt.batchSize+len(data) >= clt.flushSize() {
+		clt.flush()
+	}
 
+	if clt.buff.Len() > 0 {
+		clt.appendBuff()
+	}
+
+	r.buff = pool.Get()
+	r.buff.Write(data)
+	clt.batch = append(clt.batch, r)
+	clt.batchSize += r.buff.Len()
+	clt.pendingSince()
+}
+
+// isGzip reports whether the data starts with the gzip magic bytes
+func isGzip(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+// pendingSince keeps the arrival time of the oldest pending record, the
+// timer is programmed so it doesn't wait more than MaxRecordAge
+func (clt *Client) pendingSince() {
+	if !clt.oldest.IsZero() {
+		return
+	}
+	clt.oldest = time.Now()
+	if clt.srv.conf().MaxRecordAge > 0 {
+		clt.resetTimer()
+	}
+}
+
+// firstFlush returns a random wait up to the flush interval for the first
+// flush, the clients started together don't flush at the same time
+func firstFlush(d time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// resetTimer programs the next flush, FlushInterval after the last one or
+// when the oldest pending record reaches MaxRecordAge
+func (clt *Client) resetTimer() {
 	if !clt.t.Stop() {
 		select {
 		case <-clt.t.C:
 		default:
 		}
 	}
-	clt.t.Reset(recordsTimeout)
 
-	size := len(clt.batch)
+	if len(clt.batch) == 0 && clt.buff.Len() == 0 {
+		clt.oldest = time.Time{}
+	}
+
+	d := clt.srv.conf().FlushInterval
+	if clt.srv.conf().MaxRecordAge > 0 && !clt.oldest.IsZero() {
+		if age := clt.srv.conf().MaxRecordAge - time.Since(clt.oldest); age < d {
+			d = age
+		}
+	}
+	clt.t.Reset(d)
+}
+
+// fail discards a record of the batch that won't be sent
+func (clt *Client) fail(r batchRecord, err error) {
+	clt.srv.discard(r.buff.B, err)
+	clt.srv.release(r.bytes)
+	r.done(err)
+}
+
+// flush build the last record if need and send the records slice to AWS Firehose,
+// the batch is split in several calls if it's over the PutRecordBatch limits.
+// With MaxInFlightBatches it's sent in another goroutine once there is a free
+// slot, the error is reported later by flushAll.
+func (clt *Client) flush() error {
+	defer clt.resetTimer()
+
 	// Don't send empty batch
-	if size == 0 {
+	if len(clt.batch) == 0 {
 		return nil
 	}
 
-	// Create slice with the struct need by firehose
-	for _, b := range clt.batch {
-		clt.records = append(clt.records, &firehose.Record{Data: b.B})
+	clt.hold()
+	clt.waitThrottled()
+	batch := clt.batch
+	clt.batchSize = 0
+	clt.count = 0
+	clt.batch = nil
+	atomic.StoreInt64(&clt.stats.pending, 0)
+
+	if clt.inflight == nil {
+		return clt.send(batch)
 	}
 
-	// Create the request
-	req, output := clt.srv.awsSvc.PutRecordBatchRequest(&firehose.PutRecordBatchInput{
-		DeliveryStreamName: aws.String(clt.srv.cfg.StreamName),
-		Records:            clt.records,
-	})
+	clt.inflight <- struct{}{}
+	clt.sending.Add(1)
+	go func() {
+		defer clt.sending.Done()
+		defer func() { <-clt.inflight }()
+
+		if err := clt.send(batch); err != nil {
+			clt.Lock()
+			if clt.sendErr == nil {
+				clt.sendErr = err
+			}
+			clt.Unlock()
+		}
+	}()
+	return nil
+}
+
+// send puts the batch with as many PutRecordBatch calls as needed, the
+// failed records are retried on their own so batches can finish in any order
+func (clt *Client) send(batch []batchRecord) error {
+	var err error
+	for _, b := range splitBatch(batch) {
+		if e := clt.putBatch(b); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	// Put slice bytes in the pull after sent
+	for _, r := range batch {
+		pool.Put(r.buff)
+	}
+	return err
+}
+
+// putRecordBatch sends the records to AWS Firehose, in dry run mode it only
+// logs them and all the records are accepted
+func (clt *Client) putRecordBatch(records []types.Record, contexts []context.Context) (*firehose.PutRecordBatchOutput, error) {
+	var size int
+	for _, r := range records {
+		size += len(r.Data)
+	}
+	clt.srv.batchRecords.observe(batchRecordsBounds, int64(len(records)))
+	clt.srv.batchBytes.observe(batchBytesBounds, int64(size))
+
+	clt.Lock()
+	delay := clt.adaptDelay
+	clt.Unlock()
+	if delay > 0 {
+		clt.sleep(delay)
+	}
+
+	// Stay under the quota shared with other producers
+	if err := clt.srv.limit(clt.context(), len(records)); err != nil {
+		return nil, err
+	}
+
+	if clt.srv.conf().DryRun {
+		clt.srv.logf(LogDebug, "Firehose client %s [%d]: DRY RUN: PutRecordBatch of %d records, %d bytes", clt.stream, clt.ID, len(records), size)
+		return &firehose.PutRecordBatchOutput{
+			FailedPutCount:   aws.Int32(0),
+			RequestResponses: make([]types.PutRecordBatchResponseEntry, len(records)),
+		}, nil
+	}
 
 	// Add context timeout to the request
-	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	ctx, cancel := context.WithTimeout(clt.context(), clt.srv.conf().BatchTimeout)
 	defer cancel()
 
-	req.SetContext(ctx)
+	var end func(failed int, err error)
+	if clt.srv.conf().BatchHook != nil {
+		ctx, end = clt.srv.conf().BatchHook(ctx, BatchInfo{
+			Stream:   clt.stream,
+			Records:  len(records),
+			Bytes:    size,
+			Contexts: contexts,
+		})
+	}
 
 	// Send the request
-	err := req.Send()
+	start := time.Now()
+	output, err := clt.api.PutRecordBatch(ctx, &firehose.PutRecordBatchInput{
+		DeliveryStreamName: aws.String(clt.stream),
+		Records:            records,
+	}, clt.srv.conf().RequestOptions...)
+	clt.srv.latency.observe(latencyBounds, int64(time.Since(start)))
+
+	if end != nil {
+		failed := len(records)
+		if err == nil {
+			failed = int(aws.ToInt32(output.FailedPutCount))
+		}
+		end(failed, err)
+	}
+	return output, err
+}
+
+// splitBatch splits the records in batches of up to maxBatchRecords and maxBatchSize
+func splitBatch(batch []batchRecord) [][]batchRecord {
+	var (
+		batches [][]batchRecord
+		first   int
+		size    int
+	)
+	for i, r := range batch {
+		if i > first && (i-first >= maxBatchRecords || size+r.buff.Len() > maxBatchSize) {
+			batches = append(batches, batch[first:i])
+			first, size = i, 0
+		}
+		size += r.buff.Len()
+	}
+	return append(batches, batch[first:])
+}
+
+// putBatch sends the records to AWS Firehose with one PutRecordBatch call,
+// the failed records are sent back to the buffer
+func (clt *Client) putBatch(batch []batchRecord) error {
+	// Create slice with the struct need by firehose, it's reused unless
+	// other batches can be in flight
+	records := clt.records[:0]
+	if clt.inflight != nil {
+		records = make([]types.Record, 0, len(batch))
+	}
+	var contexts []context.Context
+	for _, r := range batch {
+		records = append(records, types.Record{Data: r.buff.B})
+		contexts = append(contexts, r.contexts...)
+	}
+
+	output, err := clt.putRecordBatch(records, contexts)
 	if err != nil {
-		if clt.srv.cfg.OnFHError != nil {
-			clt.srv.cfg.OnFHError(err)
+		err = classifyBatchError(err)
+		if clt.srv.conf().OnFHError != nil {
+			clt.srv.conf().OnFHError(err)
+		}
+		atomic.AddInt64(&clt.srv.stats.BatchesFailed, 1)
+		atomic.AddInt64(&clt.stats.batchesFailed, 1)
+		atomic.StoreInt32(&clt.stats.failing, 1)
+		if errors.Is(err, ErrBatchTimeout) {
+			atomic.AddInt64(&clt.srv.stats.BatchesTimedOut, 1)
 		}
-		if req.IsErrorThrottle() {
-			log.Printf("Firehose client %s [%d]: ERROR IsErrorThrottle: %s", clt.srv.cfg.StreamName, clt.ID, err)
+
+		// Exit gave up on the client, nothing is sent or retried anymore
+		if clt.context().Err() != nil {
+			clt.srv.logf(LogError, "Firehose client %s [%d]: ERROR exit timed out, %d records lost: %s", clt.stream, clt.ID, len(batch), err)
+			for i := range batch {
+				clt.fail(batch[i], fmt.Errorf("%w: %w", ErrExiting, err))
+			}
+			return err
+		}
+
+		if isErrorThrottle(err) {
+			// Reconnecting doesn't help with throttling, only this client waits
+			clt.srv.logf(LogWarn, "Firehose client %s [%d]: ERROR IsErrorThrottle: %s", clt.stream, clt.ID, err)
+			clt.throttle()
+		} else if isErrorExpiredToken(err) {
+			// New credentials are enough, the connection is still valid
+			clt.srv.logf(LogWarn, "Firehose client %s [%d]: ERROR credentials expired, refreshing: %s", clt.stream, clt.ID, err)
+			clt.srv.refreshCredentials()
 		} else {
-			log.Printf("Firehose client %s [%d]: ERROR PutRecordBatch->Send: %s", clt.srv.cfg.StreamName, clt.ID, err)
+			clt.srv.logf(LogError, "Firehose client %s [%d]: ERROR PutRecordBatch: %s", clt.stream, clt.ID, err)
 			var totalSize int
-			for _, b := range clt.batch {
-				totalSize += b.Len()
+			for _, r := range batch {
+				totalSize += r.buff.Len()
+			}
+			clt.srv.logf(LogDebug, "Firehose client %s [%d]: DEBUG: Records %d, Bytes %d", clt.stream, clt.ID, len(batch), totalSize)
+
+			if isConnectionError(err) {
+				clt.srv.failure(err)
+				// Sleep few millisecond because is a failure
+				clt.sleep(globalFailureWait)
+			} else {
+				// The stream replied or it's slow, a new connection won't help
+				clt.sleep(clt.srv.batchFailure())
 			}
-			log.Printf("Firehose client %s [%d]: DEBUG: Records %d, Bytes %d", clt.srv.cfg.StreamName, clt.ID, len(clt.batch), totalSize)
 		}
-		clt.srv.failure()
 
-		// Sleep few millisecond because is a failure
-		time.Sleep(globalFailureWait)
+		// Throttling, expired credentials and connection failures aren't
+		// caused by the records, those calls don't count as attempts and a
+		// critical stream doesn't drop records for a failed call
+		counted := !isErrorThrottle(err) && !isErrorExpiredToken(err) && !isConnectionError(err) && !clt.srv.conf().Critical
 
 		// Send back to the buffer
-		for i := range clt.batch {
+		for i := range batch {
 			// The limit of retry elements will be applied just to non-critical messages
-			if !clt.srv.cfg.Critical && atomic.LoadInt64(&clt.onFlyRetry) > onFlyRetryLimit {
-				log.Printf("Firehose client %s [%d]: ERROR maximum of batch records retrying (%d): %s",
-					clt.srv.cfg.StreamName, clt.ID, onFlyRetryLimit, err)
+			if !clt.srv.conf().Critical && atomic.LoadInt64(&clt.onFlyRetry) > onFlyRetryLimit {
+				clt.srv.logf(LogError, "Firehose client %s [%d]: ERROR maximum of batch records retrying (%d): %s",
+					clt.stream, clt.ID, onFlyRetryLimit, err)
+				clt.fail(batch[i], fmt.Errorf("%w: %s", ErrRetryLimit, err))
 				continue
 			}
 
+			// The call failed for all the records, they count as rejected too
+			attempts := batch[i].attempts
+			if counted {
+				if attempts >= clt.srv.conf().MaxRetries {
+					clt.srv.logf(LogError, "Firehose client %s [%d]: ERROR record dropped after %d attempts: %s",
+						clt.stream, clt.ID, attempts+1, err)
+					clt.fail(batch[i], fmt.Errorf("%w: %w", ErrTooManyAttempts, err))
+					continue
+				}
+				attempts++
+			}
+
 			// Sending back to channel, it will run a goroutine
-			clt.retry(clt.batch[i].B)
+			clt.retry(batch[i], attempts)
 		}
 	} else if *output.FailedPutCount > 0 {
-		log.Printf("Firehose client %s [%d]: partial failed, %d sent back to the buffer", clt.srv.cfg.StreamName, clt.ID, *output.FailedPutCount)
-		// Sleep few millisecond because the partial failure
-		time.Sleep(partialFailureWait)
+		clt.srv.logf(LogWarn, "Firehose client %s [%d]: partial failed, %d sent back to the buffer", clt.stream, clt.ID, *output.FailedPutCount)
+		atomic.AddInt64(&clt.srv.stats.RecordsFailed, int64(*output.FailedPutCount))
+		atomic.AddInt64(&clt.stats.recordsFailed, int64(*output.FailedPutCount))
+		atomic.StoreInt32(&clt.stats.failing, 1)
+		if isThrottled(output.RequestResponses) {
+			clt.throttle()
+		} else {
+			// Sleep few millisecond because the partial failure
+			clt.sleep(partialFailureWait)
+		}
 
 		for i, r := range output.RequestResponses {
-			if r == nil || r.ErrorCode == nil {
+			if r.ErrorCode == nil {
 				continue
 			}
 
-			if clt.srv.cfg.OnFHError != nil {
-				clt.srv.cfg.OnFHError(errors.New(*r.ErrorMessage))
+			if clt.srv.conf().OnFHError != nil {
+				clt.srv.conf().OnFHError(errors.New(*r.ErrorMessage))
 			}
 
 			// The limit of retry elements will be applied just to non-critical messages
-			if !clt.srv.cfg.Critical && atomic.LoadInt64(&clt.onFlyRetry) > onFlyRetryLimit {
-				log.Printf("Firehose client %s [%d]: ERROR maximum of batch records retrying %d, %s %s",
-					clt.srv.cfg.StreamName, clt.ID, onFlyRetryLimit, *r.ErrorCode, *r.ErrorMessage)
+			if !clt.srv.conf().Critical && atomic.LoadInt64(&clt.onFlyRetry) > onFlyRetryLimit {
+				clt.srv.logf(LogError, "Firehose client %s [%d]: ERROR maximum of batch records retrying %d, %s %s",
+					clt.stream, clt.ID, onFlyRetryLimit, *r.ErrorCode, *r.ErrorMessage)
+				clt.fail(batch[i], fmt.Errorf("%w: %s %s", ErrRetryLimit, *r.ErrorCode, *r.ErrorMessage))
 				continue
 			}
 
 			if *r.ErrorCode == firehoseError {
-				log.Printf("Firehose client %s [%d]: ERROR in AWS: %s - %s", clt.srv.cfg.StreamName, clt.ID, *r.ErrorCode, *r.ErrorMessage)
+				clt.srv.logf(LogWarn, "Firehose client %s [%d]: ERROR in AWS: %s - %s", clt.stream, clt.ID, *r.ErrorCode, *r.ErrorMessage)
+			}
+
+			// A record rejected too many times won't be accepted, drop it
+			if batch[i].attempts >= clt.srv.conf().MaxRetries {
+				clt.srv.logf(LogError, "Firehose client %s [%d]: ERROR record dropped after %d attempts, %s %s",
+					clt.stream, clt.ID, batch[i].attempts+1, *r.ErrorCode, *r.ErrorMessage)
+				clt.fail(batch[i], fmt.Errorf("%w: %s %s", ErrTooManyAttempts, *r.ErrorCode, *r.ErrorMessage))
+				continue
 			}
 
 			// Sending back to channel, it will run a goroutine
-			clt.retry(clt.batch[i].B)
+			clt.retry(batch[i], batch[i].attempts+1)
 		}
 	}
 
-	// Put slice bytes in the pull after sent
-	for _, b := range clt.batch {
-		pool.Put(b)
+	if err == nil {
+		if *output.FailedPutCount == 0 {
+			clt.Lock()
+			clt.throttles = 0
+			clt.Unlock()
+			atomic.StoreInt32(&clt.stats.failing, 0)
+			clt.srv.delivered()
+		}
+		clt.adapt(int(*output.FailedPutCount), len(batch))
+		for i, r := range output.RequestResponses {
+			if r.ErrorCode == nil {
+				atomic.AddInt64(&clt.srv.stats.RecordsSent, 1)
+				atomic.AddInt64(&clt.stats.recordsSent, 1)
+				atomic.AddInt64(&clt.srv.stats.BytesSent, int64(batch[i].buff.Len()))
+				clt.srv.release(batch[i].bytes)
+				batch[i].done(nil)
+			}
+		}
 	}
 
-	clt.batchSize = 0
-	clt.count = 0
-	clt.batch = nil
-	clt.records = nil
-
 	return err
 }
 
-// Exit finish the go routine of the client
+// flushSize returns the bytes of the batch that trigger a flush
+func (clt *Client) flushSize() int {
+	clt.Lock()
+	defer clt.Unlock()
+
+	if clt.adaptSize <= 0 || clt.adaptSize > clt.srv.conf().FlushSize {
+		return clt.srv.conf().FlushSize
+	}
+	return clt.adaptSize
+}
+
+// adapt tunes the batch size and the wait between batches with the records
+// rejected in the last one, AIMD like: the size is halved and the wait
+// increased when Firehose rejects too many, the size grows by a sixteenth
+// of FlushSize and the wait is halved with every clean batch
+func (clt *Client) adapt(failed, total int) {
+	if !clt.srv.conf().AdaptiveFlush || total == 0 {
+		return
+	}
+
+	max := clt.srv.conf().FlushSize
+	size := clt.flushSize()
+
+	clt.Lock()
+	defer clt.Unlock()
+	if float64(failed)/float64(total) > adaptiveFailures {
+		if size = size / 2; size < max/16 {
+			size = max / 16
+		}
+		if clt.adaptDelay += adaptiveDelayStep; clt.adaptDelay > maxThrottleWait {
+			clt.adaptDelay = maxThrottleWait
+		}
+	} else if failed == 0 {
+		if size += max / 16; size > max {
+			size = max
+		}
+		if clt.adaptDelay /= 2; clt.adaptDelay < time.Millisecond {
+			clt.adaptDelay = 0
+		}
+	}
+	clt.adaptSize = size
+}
+
+// Exit finish the go routine of the client, it waits up to FlushTimeout
+// for the pending records to be sent. Then the calls in flight are
+// cancelled and the records not sent yet are discarded.
 func (clt *Client) Exit() {
-	clt.finish <- true
-	<-clt.done
+	clt.stop()
+
+	t := time.NewTimer(clt.srv.conf().FlushTimeout)
+	defer t.Stop()
+
+	select {
+	case <-clt.done:
+	case <-t.C:
+		clt.srv.logf(LogError, "Firehose client %s [%d]: ERROR timeout flushing on exit, pending records could be lost", clt.stream, clt.ID)
+	}
+	if clt.cancel != nil {
+		clt.cancel()
+	}
+}
+
+// context returns the context of the calls of the client
+func (clt *Client) context() context.Context {
+	if clt.ctx == nil {
+		return context.Background()
+	}
+	return clt.ctx
+}
+
+// sleep waits for d unless Exit gave up on the client
+func (clt *Client) sleep(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-clt.context().Done():
+	}
+}
+
+// stop signals the client to stop taking records and exit, it doesn't wait
+func (clt *Client) stop() {
+	clt.finishOnce.Do(func() {
+		clt.cLock.Lock()
+		clt.stopped = true
+		clt.cLock.Unlock()
+		close(clt.finish)
+	})
+}
+
+// offer puts the item in the buffer of the client without blocking, it
+// returns false if the buffer is full or the client was stopped
+func (clt *Client) offer(item interface{}) bool {
+	clt.cLock.RLock()
+	defer clt.cLock.RUnlock()
+
+	if clt.stopped {
+		return false
+	}
+
+	select {
+	case clt.C <- item:
+		return true
+	default:
+		return false
+	}
+}
+
+// handBack puts the records left in the buffer of the client back in the
+// pool, without waiting for room. Once the pool is full the rest stay in the
+// buffer and the client sends them with its last batches.
+func (clt *Client) handBack() {
+	for {
+		select {
+		case ri := <-clt.C:
+			if !clt.srv.requeue(ri) {
+				clt.process(ri)
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// drain processes the records left in the buffer of the client
+func (clt *Client) drain() {
+	for {
+		select {
+		case ri := <-clt.C:
+			clt.process(ri)
+		default:
+			return
+		}
+	}
+}
+
+// throttle delays the next batches of the client after Firehose throttled
+// it, the wait is doubled with every consecutive throttling up to
+// maxThrottleWait
+func (clt *Client) throttle() {
+	clt.Lock()
+	d := throttleWait
+	for i := 0; i < clt.throttles && d < maxThrottleWait; i++ {
+		d *= 2
+	}
+	if d > maxThrottleWait {
+		d = maxThrottleWait
+	}
+	clt.throttles++
+	if until := time.Now().Add(d); until.After(clt.throttled) {
+		clt.throttled = until
+	}
+	clt.Unlock()
+
+	clt.waitThrottled()
+}
+
+// waitThrottled sleeps until the wait of the last throttling is over. It's
+// called by flush too, so with MaxInFlightBatches the client stops filling
+// new batches instead of only the one throttled.
+func (clt *Client) waitThrottled() {
+	clt.Lock()
+	d := time.Until(clt.throttled)
+	clt.Unlock()
+
+	if d > 0 {
+		clt.sleep(d)
+	}
+}
+
+// isErrorThrottle reports whether the error returned by the SDK is a throttling error
+func isErrorThrottle(err error) bool {
+	var unavailable *types.ServiceUnavailableException
+	if errors.As(err, &unavailable) {
+		return true
+	}
+	return retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == aws.TrueTernary
+}
+
+// classifyError wraps the SDK error with the error of its failure mode, so
+// it can be checked with errors.Is and the SDK error is still available
+func classifyError(err error) error {
+	var notFound *types.ResourceNotFoundException
+	switch {
+	case errors.As(err, &notFound):
+		return fmt.Errorf("%w: %w", ErrStreamNotFound, err)
+	case isErrorThrottle(err):
+		return fmt.Errorf("%w: %w", ErrThrottled, err)
+	case isErrorCredentials(err):
+		return fmt.Errorf("%w: %w", ErrCredentials, err)
+	case isErrorAccessDenied(err):
+		return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+	}
+	return err
+}
+
+// classifyBatchError is classifyError for the PutRecordBatch calls, the
+// deadline of their context is BatchTimeout
+func classifyBatchError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrBatchTimeout, err)
+	}
+	return classifyError(err)
+}
+
+// isErrorCredentials reports whether the request failed because the
+// credentials couldn't be retrieved or they are not valid
+func isErrorCredentials(err error) bool {
+	var signErr *v4.SigningError
+	if errors.As(err, &signErr) || isErrorExpiredToken(err) {
+		return true
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "UnrecognizedClientException", "InvalidSignatureException", "IncompleteSignature", "MissingAuthenticationToken":
+			return true
+		}
+	}
+	return false
 }
 
-func (clt *Client) retry(orig []byte) {
-	// Remove the last byte, is a newLine
-	b := make([]byte, len(orig)-len(newLine))
-	copy(b, orig[:len(orig)-len(newLine)])
+// isErrorAccessDenied reports whether the principal of the credentials is
+// not allowed to do the request
+func isErrorAccessDenied(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDeniedException"
+}
+
+// isErrorExpiredToken reports whether the request failed because the
+// temporary credentials expired
+func isErrorExpiredToken(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case expiredTokenError, "ExpiredToken", "RequestExpired":
+			return true
+		}
+	}
+	return false
+}
+
+// isConnectionError reports whether the request couldn't be sent to Firehose,
+// the credentials couldn't be signed or the stream is gone, a new connection
+// could fix them. Timeouts and the errors replied by the stream are not, a
+// slow or failing stream isn't fixed by connecting again.
+func isConnectionError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var (
+		notFound *types.ResourceNotFoundException
+		sendErr  *smithyhttp.RequestSendError
+		netErr   net.Error
+		signErr  *v4.SigningError
+	)
+	return errors.As(err, &notFound) || errors.As(err, &sendErr) || errors.As(err, &netErr) || errors.As(err, &signErr)
+}
+
+// isThrottled reports whether any of the records was rejected because the
+// stream is over its throughput
+func isThrottled(responses []types.PutRecordBatchResponseEntry) bool {
+	for _, r := range responses {
+		if r.ErrorCode != nil && *r.ErrorCode == throttleError {
+			return true
+		}
+	}
+	return false
+}
+
+func (clt *Client) retry(r batchRecord, attempts int) {
+	// Copy the record, the original buffer goes back to the pool
+	b := make([]byte, r.buff.Len())
+	copy(b, r.buff.B)
 
 	go func(b []byte) {
 		atomic.AddInt64(&clt.onFlyRetry, 1)
 		defer atomic.AddInt64(&clt.onFlyRetry, -1)
-		clt.srv.C <- b
+
+		// Avoid sending to C while it's being closed
+		clt.srv.chLock.RLock()
+		defer clt.srv.chLock.RUnlock()
+
+		select {
+		case <-clt.srv.ctx.Done():
+			// The pool is exiting, C could be already closed
+		default:
+			select {
+			case clt.srv.C <- &retryRecord{b: b, attempts: attempts, bytes: r.bytes, callbacks: r.callbacks, contexts: r.contexts}:
+				return
+			case <-clt.srv.ctx.Done():
+			}
+		}
+		clt.srv.discard(b, ErrExiting)
+		clt.srv.release(r.bytes)
+		r.done(ErrExiting)
 	}(b)
 }
@@ -0,0 +1,840 @@
+package firehosePool
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+func TestAppendBuffGzip(t *testing.T) {
+	clt := &Client{
+		srv:  &Server{cfg: Config{Compression: CompressionGzip, MaxRecordSize: maxRecordSize}},
+		buff: pool.Get(),
+	}
+
+	raw := []byte("first record\nsecond record\n")
+	clt.buff.Write(raw)
+	clt.appendBuff()
+
+	if len(clt.batch) != 1 {
+		t.Fatalf("expected one record in the batch, got %d", len(clt.batch))
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(clt.batch[0].buff.B))
+	if err != nil {
+		t.Fatalf("invalid gzip record: %s", err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("invalid gzip record: %s", err)
+	}
+
+	if !bytes.Equal(b, raw) {
+		t.Errorf("expected %q, got %q", raw, b)
+	}
+
+	if clt.buff.Len() != 0 {
+		t.Errorf("expected an empty buffer after append, got %d bytes", clt.buff.Len())
+	}
+}
+
+func TestNewClientQueueSize(t *testing.T) {
+	for _, c := range []struct{ size, want int }{
+		{0, workerQueueSize},
+		{4, 4},
+		{-1, 0},
+	} {
+		srv := newTestServer(1)
+		srv.cfg.WorkerQueueSize = c.size
+		srv.cfg.FlushTimeout = time.Second
+		clt := NewClient(srv)
+		if cap(clt.C) != c.want {
+			t.Errorf("WorkerQueueSize %d: expected a queue of %d, got %d", c.size, c.want, cap(clt.C))
+		}
+		clt.Exit()
+	}
+}
+
+func TestFrame(t *testing.T) {
+	for _, c := range []struct {
+		framing   string
+		aggregate bool
+		want      string
+	}{
+		{"", false, "\x00\x01\n"},
+		{FramingNewline, false, "\x00\x01\n"},
+		{FramingNone, false, "\x00\x01"},
+		{FramingLengthPrefixed, false, "\x00\x00\x00\x02\x00\x01"},
+		{FramingNone, true, "\x00\x00\x00\x02\x00\x01"},
+	} {
+		srv := newTestServer(1)
+		srv.cfg.Framing = c.framing
+		srv.cfg.Aggregate = c.aggregate
+
+		// The spare capacity of the record must not be written
+		record := append(make([]byte, 0, 8), 0, 1)
+		got := srv.frame(nil, record)
+		if string(got) != c.want || srv.framedLen(record) != len(c.want) {
+			t.Errorf("%s: expected %q, got %q", c.framing, c.want, got)
+		}
+		if spare := record[:3]; spare[2] != 0 {
+			t.Errorf("%s: the record was modified", c.framing)
+		}
+	}
+}
+
+func TestFramingNone(t *testing.T) {
+	srv := newTestServer(2)
+	srv.cfg.FlushInterval = time.Minute
+	srv.cfg.FlushSize = maxBatchSize
+	srv.cfg.MaxRecords = maxBatchRecords
+	srv.cfg.FlushTimeout = time.Second
+	srv.cfg.ConcatRecords = true
+	srv.cfg.Framing = FramingNone
+
+	var records []string
+	srv.awsSvc = &fakeAPI{put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+		for _, r := range in.Records {
+			records = append(records, string(r.Data))
+		}
+		return &firehose.PutRecordBatchOutput{
+			FailedPutCount:   aws.Int32(0),
+			RequestResponses: make([]types.PutRecordBatchResponseEntry, len(in.Records)),
+		}, nil
+	}}
+	clt := NewClient(srv)
+
+	srv.C <- []byte{0x08, 0x96, 0x01}
+	srv.C <- []byte{0x0a, 0x00}
+	for len(srv.C) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clt.Exit()
+
+	// Binary records are not concatenated nor delimited
+	if len(records) != 2 || records[0] != "\x08\x96\x01" || records[1] != "\x0a\x00" {
+		t.Errorf("unexpected records %q", records)
+	}
+}
+
+func TestFirstFlush(t *testing.T) {
+	d := time.Second
+	var min, max time.Duration = d, 0
+	for i := 0; i < 1000; i++ {
+		f := firstFlush(d)
+		if f < 0 || f > d {
+			t.Fatalf("first flush %s out of [0, %s]", f, d)
+		}
+		if f < min {
+			min = f
+		}
+		if f > max {
+			max = f
+		}
+	}
+	// The clients are spread over the interval
+	if max-min < d/2 {
+		t.Errorf("expected the first flushes spread over %s, got [%s, %s]", d, min, max)
+	}
+}
+
+func TestAdapt(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.FlushSize = 1600
+	clt := &Client{srv: srv}
+
+	clt.adapt(5, 10)
+	if clt.flushSize() != 1600 || clt.adaptDelay != 0 {
+		t.Errorf("expected no changes without AdaptiveFlush")
+	}
+
+	srv.cfg.AdaptiveFlush = true
+	clt.adapt(5, 10)
+	clt.adapt(5, 10)
+	if clt.flushSize() != 400 || clt.adaptDelay != 2*adaptiveDelayStep {
+		t.Errorf("expected 400 bytes and %s after 2 failing batches, got %d and %s", 2*adaptiveDelayStep, clt.flushSize(), clt.adaptDelay)
+	}
+
+	clt.adapt(0, 10)
+	if clt.flushSize() != 500 || clt.adaptDelay != adaptiveDelayStep {
+		t.Errorf("expected 500 bytes and %s after a clean batch, got %d and %s", adaptiveDelayStep, clt.flushSize(), clt.adaptDelay)
+	}
+
+	for i := 0; i < 20; i++ {
+		clt.adapt(0, 10)
+	}
+	if clt.flushSize() != 1600 || clt.adaptDelay != 0 {
+		t.Errorf("expected back to FlushSize without delay, got %d and %s", clt.flushSize(), clt.adaptDelay)
+	}
+}
+
+func TestDiscardErrChan(t *testing.T) {
+	ch := make(chan FailedRecord, 1)
+	srv := &Server{cfg: Config{ErrChan: ch}}
+
+	b := []byte("record")
+	srv.discard(b, ErrRecordTooLarge)
+	b[0] = 'R' // The published record must be a copy
+	srv.discard(b, ErrRecordTooLarge)
+
+	f := <-ch
+	if string(f.Data) != "record" || f.Err != ErrRecordTooLarge {
+		t.Errorf("unexpected failed record %q: %v", f.Data, f.Err)
+	}
+
+	st := srv.Stats()
+	if st.RecordsDropped != 2 || st.FailedLost != 1 {
+		t.Errorf("expected 2 dropped and 1 lost, got %d and %d", st.RecordsDropped, st.FailedLost)
+	}
+}
+
+func TestIsErrorThrottle(t *testing.T) {
+	if !isErrorThrottle(&types.ServiceUnavailableException{}) {
+		t.Error("ServiceUnavailableException must be a throttling error")
+	}
+	if isErrorThrottle(&types.ResourceNotFoundException{}) {
+		t.Error("ResourceNotFoundException is not a throttling error")
+	}
+
+	code := throttleError
+	if !isThrottled([]types.PutRecordBatchResponseEntry{{}, {ErrorCode: &code}}) {
+		t.Error("expected a throttled response")
+	}
+}
+
+func TestIsErrorExpiredToken(t *testing.T) {
+	if !isErrorExpiredToken(&smithy.GenericAPIError{Code: expiredTokenError}) {
+		t.Error("ExpiredTokenException must be an expired token error")
+	}
+	if isErrorExpiredToken(&types.ServiceUnavailableException{}) {
+		t.Error("ServiceUnavailableException is not an expired token error")
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	if !isConnectionError(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}) {
+		t.Error("network errors are connection errors")
+	}
+	if !isConnectionError(&smithy.OperationError{Err: &smithyhttp.RequestSendError{Err: errors.New("EOF")}}) {
+		t.Error("errors sending the request are connection errors")
+	}
+	if isConnectionError(&smithyhttp.RequestSendError{Err: fmt.Errorf("read: %w", context.DeadlineExceeded)}) {
+		t.Error("timeouts are not connection errors")
+	}
+	if isConnectionError(errors.New("serialization failed")) {
+		t.Error("unknown errors are not connection errors")
+	}
+	if !isConnectionError(&types.ResourceNotFoundException{}) {
+		t.Error("ResourceNotFoundException is a connection error")
+	}
+	if isConnectionError(&types.InvalidArgumentException{}) {
+		t.Error("InvalidArgumentException is not a connection error")
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want error
+	}{
+		{&types.ResourceNotFoundException{}, ErrStreamNotFound},
+		{&types.ServiceUnavailableException{}, ErrThrottled},
+		{&smithy.GenericAPIError{Code: expiredTokenError}, ErrCredentials},
+		{&smithy.GenericAPIError{Code: "UnrecognizedClientException"}, ErrCredentials},
+		{&smithy.GenericAPIError{Code: "AccessDeniedException"}, ErrAccessDenied},
+	} {
+		err := classifyError(c.err)
+		if !errors.Is(err, c.want) {
+			t.Errorf("expected %s for %T, got %v", c.want, c.err, err)
+		}
+		if !errors.Is(err, c.err) {
+			t.Errorf("the SDK error %T must be kept", c.err)
+		}
+	}
+
+	err := errors.New("other")
+	if classifyError(err) != err {
+		t.Errorf("unknown errors must not be wrapped")
+	}
+
+	// Only the deadline of a PutRecordBatch call is BatchTimeout
+	err = fmt.Errorf("operation error: %w", context.DeadlineExceeded)
+	if errors.Is(classifyError(err), ErrBatchTimeout) {
+		t.Errorf("the deadline of other calls is not %s", ErrBatchTimeout)
+	}
+	if got := classifyBatchError(err); !errors.Is(got, ErrBatchTimeout) || !errors.Is(got, context.DeadlineExceeded) {
+		t.Errorf("expected %s, got %v", ErrBatchTimeout, got)
+	}
+	if got := classifyBatchError(&types.ServiceUnavailableException{}); !errors.Is(got, ErrThrottled) {
+		t.Errorf("expected %s, got %v", ErrThrottled, got)
+	}
+}
+
+func TestBatchRecordCallbacks(t *testing.T) {
+	clt := &Client{
+		srv:  &Server{cfg: Config{MaxRecordSize: maxRecordSize}},
+		buff: pool.Get(),
+	}
+
+	var results []error
+	fn := func(err error) { results = append(results, err) }
+
+	clt.buff.Write([]byte("a\nb\n"))
+	clt.pending = []func(error){fn, fn}
+	clt.appendBuff()
+
+	if len(clt.pending) != 0 {
+		t.Fatalf("pending callbacks must move to the batch record")
+	}
+
+	clt.fail(clt.batch[0], ErrExiting)
+	if len(results) != 2 || results[0] != ErrExiting || results[1] != ErrExiting {
+		t.Errorf("expected two %s results, got %v", ErrExiting, results)
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	var batch []batchRecord
+	for i := 0; i < maxBatchRecords+10; i++ {
+		b := pool.Get()
+		b.Write([]byte("record\n"))
+		batch = append(batch, batchRecord{buff: b})
+	}
+
+	batches := splitBatch(batch)
+	if len(batches) != 2 || len(batches[0]) != maxBatchRecords || len(batches[1]) != 10 {
+		t.Errorf("expected batches of %d and 10 records, got %d batches", maxBatchRecords, len(batches))
+	}
+
+	// Large records are split by size
+	big := make([]byte, maxBatchSize/2+1)
+	batch = nil
+	for i := 0; i < 3; i++ {
+		b := pool.Get()
+		b.Write(big)
+		batch = append(batch, batchRecord{buff: b})
+	}
+	if batches := splitBatch(batch); len(batches) != 3 {
+		t.Errorf("expected 3 batches, got %d", len(batches))
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.DryRun = true
+	clt := &Client{
+		srv:  srv,
+		buff: pool.Get(),
+		t:    time.NewTimer(time.Minute),
+	}
+
+	var result error = ErrExiting
+	clt.buff.Write([]byte("record\n"))
+	clt.pending = []func(error){func(err error) { result = err }}
+	clt.appendBuff()
+
+	if err := clt.flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result != nil {
+		t.Errorf("expected the record accepted, got %v", result)
+	}
+	if s := srv.Stats(); s.RecordsSent != 1 || s.BytesSent != 7 {
+		t.Errorf("expected 1 record and 7 bytes sent, got %d and %d", s.RecordsSent, s.BytesSent)
+	}
+}
+
+func TestFlushPartialFailure(t *testing.T) {
+	srv := newTestServer(10)
+	srv.cfg.MaxRetries = maxRecordRetries
+	fake := &fakeAPI{put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+		return &firehose.PutRecordBatchOutput{
+			FailedPutCount: aws.Int32(1),
+			RequestResponses: []types.PutRecordBatchResponseEntry{
+				{RecordId: aws.String("1")},
+				{ErrorCode: aws.String(firehoseError), ErrorMessage: aws.String("failed")},
+			},
+		}, nil
+	}}
+	clt := &Client{
+		srv:  srv,
+		api:  fake,
+		buff: pool.Get(),
+		t:    time.NewTimer(time.Minute),
+	}
+
+	for _, r := range []string{"sent\n", "failed\n"} {
+		clt.buff.Write([]byte(r))
+		clt.appendBuff()
+	}
+	if err := clt.flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s := srv.Stats(); s.RecordsSent != 1 || s.RecordsFailed != 1 {
+		t.Errorf("expected 1 record sent and 1 failed, got %d and %d", s.RecordsSent, s.RecordsFailed)
+	}
+
+	// The failed record is sent back to the buffer
+	select {
+	case ri := <-srv.C:
+		rr, ok := ri.(*retryRecord)
+		if !ok || string(rr.b) != "failed\n" || rr.attempts != 1 {
+			t.Errorf("unexpected retry %#v", ri)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the failed record was not retried")
+	}
+}
+
+func TestBatchTimeout(t *testing.T) {
+	srv := newTestServer(10)
+	srv.cfg.BatchTimeout = 10 * time.Millisecond
+	srv.cfg.MaxErrors = 10
+	srv.cfg.MaxRetries = maxRecordRetries
+	clt := &Client{
+		srv:  srv,
+		api:  &fakeAPI{hang: true},
+		buff: pool.Get(),
+		t:    time.NewTimer(time.Minute),
+	}
+
+	clt.buff.Write([]byte("hung\n"))
+	clt.appendBuff()
+	if err := clt.flush(); !errors.Is(err, ErrBatchTimeout) {
+		t.Fatalf("expected ErrBatchTimeout, got %v", err)
+	}
+
+	if s := srv.Stats(); s.BatchesFailed != 1 || s.BatchesTimedOut != 1 {
+		t.Errorf("expected 1 batch timed out, got %d failed and %d timed out", s.BatchesFailed, s.BatchesTimedOut)
+	}
+
+	// The record is sent back to the buffer
+	select {
+	case ri := <-srv.C:
+		if rr, ok := ri.(*retryRecord); !ok || string(rr.b) != "hung\n" || rr.attempts != 1 {
+			t.Errorf("unexpected retry %#v", ri)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the record was not retried")
+	}
+}
+
+func TestBatchErrorMaxRetries(t *testing.T) {
+	srv := newTestServer(10)
+	srv.cfg.ErrorsFrame = time.Minute
+	srv.cfg.MaxErrors = 10
+	srv.cfg.MaxBatchErrors = 10
+	srv.cfg.MaxRetries = 1
+	fake := &fakeAPI{put: func(*firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+		return nil, &smithy.GenericAPIError{Code: "InvalidArgumentException", Message: "failed"}
+	}}
+	clt := &Client{
+		srv:  srv,
+		api:  fake,
+		buff: pool.Get(),
+		t:    time.NewTimer(time.Minute),
+	}
+
+	var result []error
+	clt.buff.Write([]byte("failed\n"))
+	clt.pending = []func(error){func(err error) { result = append(result, err) }}
+	clt.appendBuff()
+	clt.flush()
+
+	// Sent again once, then dropped
+	select {
+	case ri := <-srv.C:
+		clt.process(ri)
+	case <-time.After(time.Second):
+		t.Fatalf("the record was not retried")
+	}
+	clt.flush()
+
+	select {
+	case ri := <-srv.C:
+		t.Fatalf("unexpected retry %#v after MaxRetries", ri)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if fake.calls != 2 || len(result) != 1 || !errors.Is(result[0], ErrTooManyAttempts) {
+		t.Errorf("expected the record dropped after 2 calls, got %d calls and %v", fake.calls, result)
+	}
+	if n := srv.Stats().RecordsDropped; n != 1 {
+		t.Errorf("expected 1 record dropped, got %d", n)
+	}
+}
+
+func TestMaxRetriesConfig(t *testing.T) {
+	for _, c := range []struct {
+		retries int
+		want    int
+	}{
+		{0, maxRecordRetries},
+		{5, 5},
+		{-1, -1},
+	} {
+		srv := newTestServer(1)
+		srv.Reload(&Config{StreamName: "test", DryRun: true, MaxRetries: c.retries})
+		if srv.conf().MaxRetries != c.want {
+			t.Errorf("expected %d retries, got %d", c.want, srv.conf().MaxRetries)
+		}
+		srv.Exit()
+	}
+
+	// Without retries the record is dropped after the first call
+	srv := newTestServer(10)
+	srv.cfg.MaxRetries = -1
+	srv.cfg.ErrorsFrame = time.Minute
+	srv.cfg.MaxErrors = 10
+	srv.cfg.MaxBatchErrors = 10
+	fake := &fakeAPI{put: func(*firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+		return nil, &smithy.GenericAPIError{Code: "InvalidArgumentException", Message: "failed"}
+	}}
+	clt := &Client{srv: srv, api: fake, buff: pool.Get(), t: time.NewTimer(time.Minute)}
+	clt.buff.Write([]byte("failed\n"))
+	clt.appendBuff()
+	clt.flush()
+	if len(srv.C) != 0 || srv.Stats().RecordsDropped != 1 {
+		t.Errorf("expected the record dropped without retries")
+	}
+}
+
+func TestMaxRetriesNotCounted(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		err      error
+		critical bool
+	}{
+		{"throttled", &types.ServiceUnavailableException{Message: aws.String("slow down")}, false},
+		{"connection", &smithy.OperationError{Err: &smithyhttp.RequestSendError{Err: errors.New("EOF")}}, false},
+		{"critical", &smithy.GenericAPIError{Code: "InvalidArgumentException", Message: "failed"}, true},
+	} {
+		srv := newTestServer(10)
+		srv.cfg.Critical = c.critical
+		srv.cfg.MaxRetries = -1
+		srv.cfg.ErrorsFrame = time.Minute
+		srv.cfg.MaxErrors = 10
+		srv.cfg.MaxBatchErrors = 10
+		fake := &fakeAPI{put: func(*firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+			return nil, c.err
+		}}
+		clt := &Client{srv: srv, api: fake, buff: pool.Get(), t: time.NewTimer(time.Minute)}
+		clt.buff.Write([]byte("failed\n"))
+		clt.appendBuff()
+		clt.flush()
+
+		// Even without retries the record goes back to the buffer with
+		// the same attempts
+		select {
+		case ri := <-srv.C:
+			if r, ok := ri.(*retryRecord); !ok || r.attempts != 0 {
+				t.Errorf("%s: expected the record retried without counting the attempt, got %#v", c.name, ri)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: expected the record retried", c.name)
+		}
+		if n := srv.Stats().RecordsDropped; n != 0 {
+			t.Errorf("%s: expected nothing dropped, got %d", c.name, n)
+		}
+	}
+}
+
+// blockingAPI waits for release in every PutRecordBatch, the records "fail\n"
+// are rejected
+type blockingAPI struct {
+	fakeAPI
+	started chan string
+	release chan struct{}
+}
+
+func (a *blockingAPI) PutRecordBatch(ctx context.Context, in *firehose.PutRecordBatchInput, _ ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error) {
+	a.started <- string(in.Records[0].Data)
+	<-a.release
+
+	out := &firehose.PutRecordBatchOutput{FailedPutCount: aws.Int32(0)}
+	for _, r := range in.Records {
+		e := types.PutRecordBatchResponseEntry{RecordId: aws.String("1")}
+		if string(r.Data) == "fail\n" {
+			e = types.PutRecordBatchResponseEntry{ErrorCode: aws.String(firehoseError), ErrorMessage: aws.String("failed")}
+			*out.FailedPutCount++
+		}
+		out.RequestResponses = append(out.RequestResponses, e)
+	}
+	return out, nil
+}
+
+func TestMaxInFlightBatches(t *testing.T) {
+	srv := newTestServer(10)
+	srv.cfg.MaxRetries = maxRecordRetries
+	api := &blockingAPI{started: make(chan string, 3), release: make(chan struct{})}
+	clt := &Client{
+		srv:      srv,
+		api:      api,
+		buff:     pool.Get(),
+		t:        time.NewTimer(time.Minute),
+		inflight: make(chan struct{}, 2),
+	}
+
+	// The client keeps building batches while two are in flight
+	for _, r := range []string{"fail\n", "second\n"} {
+		clt.buff.Write([]byte(r))
+		clt.appendBuff()
+		if err := clt.flush(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-api.started:
+		case <-time.After(time.Second):
+			t.Fatalf("expected 2 batches in flight")
+		}
+	}
+
+	// The third one waits for a free slot
+	clt.buff.Write([]byte("third\n"))
+	flushed := make(chan error, 1)
+	go func() { flushed <- clt.flushAll() }()
+	select {
+	case r := <-api.started:
+		t.Fatalf("unexpected third batch in flight %q", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(api.release)
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("flushAll didn't wait for the batches in flight")
+	}
+
+	if s := srv.Stats(); s.RecordsSent != 2 || s.RecordsFailed != 1 {
+		t.Errorf("expected 2 records sent and 1 failed, got %d and %d", s.RecordsSent, s.RecordsFailed)
+	}
+	select {
+	case ri := <-srv.C:
+		if rr, ok := ri.(*retryRecord); !ok || string(rr.b) != "fail\n" || rr.attempts != 1 {
+			t.Errorf("unexpected retry %#v", ri)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the failed record was not retried")
+	}
+}
+
+func TestThrottleInFlight(t *testing.T) {
+	srv := newTestServer(10)
+	srv.cfg.DryRun = true
+	clt := &Client{
+		srv:      srv,
+		buff:     pool.Get(),
+		t:        time.NewTimer(time.Minute),
+		inflight: make(chan struct{}, 2),
+	}
+
+	// A throttled batch in flight delays the next ones of the client
+	clt.throttled = time.Now().Add(100 * time.Millisecond)
+	clt.buff.Write([]byte("record\n"))
+	clt.appendBuff()
+	start := time.Now()
+	if err := clt.flushAll(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("expected the batch delayed by the throttling, sent after %s", d)
+	}
+}
+
+func TestExitTimeout(t *testing.T) {
+	srv := newTestServer(10)
+	srv.cfg.FlushInterval = time.Minute
+	srv.cfg.FlushSize = maxBatchSize
+	srv.cfg.MaxRecords = maxBatchRecords
+	srv.cfg.BatchTimeout = time.Minute
+	srv.cfg.FlushTimeout = 50 * time.Millisecond
+	srv.awsSvc = &fakeAPI{hang: true}
+	clt := NewClient(srv)
+
+	result := make(chan error, 1)
+	srv.C <- &callbackRecord{record: []byte("record"), fn: func(err error) { result <- err }}
+	for len(srv.C) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clt.Exit()
+
+	// The hung call is cancelled once Exit stops waiting
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrExiting) {
+			t.Errorf("expected %s, got %v", ErrExiting, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the client kept sending after Exit")
+	}
+	srv.running.Wait()
+	if n := srv.Stats().RecordsDropped; n != 1 {
+		t.Errorf("expected 1 record dropped, got %d", n)
+	}
+}
+
+func TestMaxRecordAge(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.DryRun = true
+	srv.cfg.FlushInterval = time.Minute
+	srv.cfg.FlushSize = maxBatchSize
+	srv.cfg.MaxRecords = maxBatchRecords
+	srv.cfg.MaxRecordAge = 10 * time.Millisecond
+	srv.cfg.FlushTimeout = time.Second
+	clt := NewClient(srv)
+	defer clt.Exit()
+
+	srv.C <- []byte("record")
+	deadline := time.Now().Add(time.Second)
+	for srv.Stats().RecordsSent == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the record was not sent after MaxRecordAge")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSkipCompressed(t *testing.T) {
+	srv := newTestServer(2)
+	srv.cfg.FlushInterval = time.Minute
+	srv.cfg.FlushSize = maxBatchSize
+	srv.cfg.MaxRecords = maxBatchRecords
+	srv.cfg.ConcatRecords = true
+	srv.cfg.Compression = CompressionGzip
+	srv.cfg.SkipCompressed = true
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("compressed"))
+	w.Close()
+
+	var records [][]byte
+	srv.awsSvc = &fakeAPI{put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+		for _, r := range in.Records {
+			records = append(records, r.Data)
+		}
+		return &firehose.PutRecordBatchOutput{
+			FailedPutCount:   aws.Int32(0),
+			RequestResponses: make([]types.PutRecordBatchResponseEntry, len(in.Records)),
+		}, nil
+	}}
+	srv.cfg.FlushTimeout = time.Second
+	clt := NewClient(srv)
+
+	srv.C <- []byte("plain")
+	srv.C <- gz.Bytes()
+	for len(srv.C) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clt.Exit()
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if !bytes.Equal(records[1], gz.Bytes()) {
+		t.Errorf("the gzipped record must be sent as it is")
+	}
+}
+
+type ctxKey struct{}
+
+func TestBatchHook(t *testing.T) {
+	srv := newTestServer(2)
+	srv.cfg.FlushInterval = time.Minute
+	srv.cfg.FlushSize = maxBatchSize
+	srv.cfg.MaxRecords = maxBatchRecords
+	srv.cfg.ConcatRecords = true
+	srv.cfg.FlushTimeout = time.Second
+	srv.awsSvc = &fakeAPI{put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+		return &firehose.PutRecordBatchOutput{
+			FailedPutCount:   aws.Int32(0),
+			RequestResponses: make([]types.PutRecordBatchResponseEntry, len(in.Records)),
+		}, nil
+	}}
+
+	var info BatchInfo
+	var ended bool
+	srv.cfg.BatchHook = func(ctx context.Context, b BatchInfo) (context.Context, func(int, error)) {
+		info = b
+		return ctx, func(failed int, err error) {
+			ended = failed == 0 && err == nil
+		}
+	}
+
+	clt := NewClient(srv)
+	for _, v := range []string{"a", "b"} {
+		ctx := context.WithValue(context.Background(), ctxKey{}, v)
+		if err := srv.SendWithContext(ctx, []byte(v)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	for len(srv.C) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clt.Exit()
+
+	if info.Records != 1 || info.Bytes != 4 || len(info.Contexts) != 2 || !ended {
+		t.Fatalf("unexpected batch %+v, ended %v", info, ended)
+	}
+	if info.Contexts[0].Value(ctxKey{}) != "a" || info.Contexts[1].Value(ctxKey{}) != "b" {
+		t.Errorf("expected the contexts of the records")
+	}
+}
+
+func TestHandBackFull(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.MaxRecords, srv.cfg.FlushSize = defaultMaxRecords, defaultFlushSize
+	srv.C <- []byte("full")
+	clt := &Client{srv: srv, C: make(chan interface{}, 2), buff: pool.Get()}
+
+	var result error
+	clt.C <- []byte("a")
+	clt.C <- &callbackRecord{record: []byte("b"), fn: func(err error) { result = err }}
+
+	done := make(chan struct{})
+	go func() {
+		clt.handBack()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("handBack blocked with the pool full")
+	}
+
+	// The records that don't fit are kept by the client
+	if clt.buff.Len() == 0 || len(clt.C) != 1 || result != nil {
+		t.Errorf("expected the records kept by the client, got %d buffered and %d queued", clt.buff.Len(), len(clt.C))
+	}
+	if n := srv.Stats().RecordsDropped; n != 0 {
+		t.Errorf("expected no records dropped, got %d", n)
+	}
+
+	// Once the pool is exiting they are discarded
+	srv.cancel()
+	clt.handBack()
+	if result != ErrExiting || len(clt.C) != 0 {
+		t.Errorf("expected the record discarded with %s, got %v", ErrExiting, result)
+	}
+	if n := srv.Stats().RecordsDropped; n != 1 {
+		t.Errorf("expected 1 record dropped, got %d", n)
+	}
+}
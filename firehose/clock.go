@@ -0,0 +1,29 @@
+package firehosePool
+
+import "time"
+
+// clock is the source of time of the error frames and the connection
+// retries, the tests replace it to advance the time without waiting
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (srv *Server) now() time.Time {
+	if srv.clock == nil {
+		return time.Now()
+	}
+	return srv.clock.Now()
+}
+
+func (srv *Server) after(d time.Duration) <-chan time.Time {
+	if srv.clock == nil {
+		return time.After(d)
+	}
+	return srv.clock.After(d)
+}
@@ -0,0 +1,149 @@
+package firehosePool
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// fakeClock only moves with Advance, waits are published in waits
+type fakeClock struct {
+	sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+	waits   chan time.Duration
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0), waits: make(chan time.Duration, 10)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	c.waits <- d
+	return ch
+}
+
+// Advance moves the time and fires the waits that expired
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
+
+func TestFailureErrorsFrame(t *testing.T) {
+	clock := newFakeClock()
+	srv := newTestServer(1)
+	srv.clock = clock
+	srv.cfg.ErrorsFrame = time.Minute
+	srv.cfg.MaxErrors = 10
+
+	srv.failure(errors.New("first"))
+	clock.Advance(30 * time.Second)
+	srv.failure(errors.New("second"))
+	if srv.errors != 2 {
+		t.Errorf("expected 2 errors in the frame, got %d", srv.errors)
+	}
+
+	clock.Advance(time.Minute + time.Second)
+	srv.failure(errors.New("third"))
+	if srv.errors != 1 {
+		t.Errorf("expected the errors reset after the frame, got %d", srv.errors)
+	}
+}
+
+func TestReloadBackoff(t *testing.T) {
+	clock := newFakeClock()
+	srv := newTestServer(1)
+	srv.clock = clock
+	srv.cfg.StreamName = "test"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.ConnectionRetry = time.Second
+	srv.cfg.MaxConnectionRetry = 4 * time.Second
+	srv.cfg.FirehoseAPI = &fakeAPI{status: types.DeliveryStreamStatusCreating}
+
+	go srv._reload()
+	defer srv.Exit()
+	srv.chReload <- true
+
+	for _, max := range []time.Duration{1, 2, 4, 4} {
+		max *= time.Second
+		var d time.Duration
+		select {
+		case d = <-clock.waits:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no connection retry")
+		}
+		if d < max/2 || d > max {
+			t.Errorf("backoff %s out of [%s, %s]", d, max/2, max)
+		}
+		clock.Advance(max)
+	}
+}
+
+func TestReloadOnFatal(t *testing.T) {
+	clock := newFakeClock()
+	srv := newTestServer(1)
+	srv.clock = clock
+	srv.cfg.StreamName = "test"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.ConnectionRetry = time.Second
+	srv.cfg.MaxConnectionRetry = time.Second
+	srv.cfg.FirehoseAPI = &fakeAPI{status: types.DeliveryStreamStatusCreating}
+	srv.cfg.MaxConnectionFailures = 2
+	fatal := make(chan error, 3)
+	srv.cfg.OnFatal = func(err error) {
+		fatal <- err
+	}
+
+	go srv._reload()
+	defer srv.Exit()
+	srv.chReload <- true
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-clock.waits:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no connection retry")
+		}
+		clock.Advance(time.Second)
+	}
+
+	select {
+	case err := <-fatal:
+		if !errors.Is(err, ErrStreamNotActive) {
+			t.Errorf("expected %s, got %v", ErrStreamNotActive, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("OnFatal not called")
+	}
+	if len(fatal) != 0 {
+		t.Errorf("OnFatal must be called once")
+	}
+}
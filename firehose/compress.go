@@ -0,0 +1,108 @@
+package firehosePool
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor compresses the content of every Firehose record, it's used by
+// all the clients at the same time so it must be safe for concurrent use
+type Compressor interface {
+	// Compress appends the compressed data to dst and returns it
+	Compress(dst, data []byte) ([]byte, error)
+	// MaxLen is the largest size of n bytes once compressed, the records
+	// are cut so they fit in the Firehose limit even if they don't compress
+	MaxLen(n int) int
+}
+
+var (
+	compressorsLock sync.RWMutex
+	compressors     = map[string]Compressor{
+		CompressionGzip:   gzipCompressor{},
+		CompressionSnappy: snappyCompressor{},
+		CompressionZstd:   &zstdCompressor{},
+	}
+)
+
+// RegisterCompressor makes the compressor available as the Compression of
+// the pools, it replaces the one with the same name
+func RegisterCompressor(name string, c Compressor) {
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+	compressors[name] = c
+}
+
+// compressor returns the compressor registered with the name, nil for none
+// or unknown ones
+func compressor(name string) Compressor {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	return compressors[name]
+}
+
+// gzipCompressor keeps the writers to reuse their buffers
+type gzipCompressor struct{}
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+func (gzipCompressor) Compress(dst, data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(dst)
+	gz := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(gz)
+
+	gz.Reset(out)
+	if _, err := gz.Write(data); err != nil {
+		return dst, err
+	}
+	if err := gz.Close(); err != nil {
+		return dst, err
+	}
+	return out.Bytes(), nil
+}
+
+// MaxLen leaves room for the headers and the stored blocks of uncompressible data
+func (gzipCompressor) MaxLen(n int) int {
+	return n + gzipOverhead
+}
+
+// snappyCompressor uses the snappy block format, not the framed one
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(dst, data []byte) ([]byte, error) {
+	return append(dst, snappy.Encode(nil, data)...), nil
+}
+
+func (snappyCompressor) MaxLen(n int) int {
+	return snappy.MaxEncodedLen(n)
+}
+
+// zstdCompressor shares one encoder, it's created on the first use
+type zstdCompressor struct {
+	once sync.Once
+	enc  *zstd.Encoder
+	err  error
+}
+
+func (z *zstdCompressor) Compress(dst, data []byte) ([]byte, error) {
+	z.once.Do(func() {
+		z.enc, z.err = zstd.NewWriter(nil)
+	})
+	if z.err != nil {
+		return dst, fmt.Errorf("zstd: %w", z.err)
+	}
+	return z.enc.EncodeAll(data, dst), nil
+}
+
+// MaxLen is the ZSTD_COMPRESSBOUND of the reference implementation
+func (*zstdCompressor) MaxLen(n int) int {
+	bound := n + n>>8
+	if n < 128<<10 {
+		bound += (128<<10 - n) >> 11
+	}
+	return bound
+}
@@ -0,0 +1,83 @@
+package firehosePool
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestAppendBuffCompression(t *testing.T) {
+	raw := bytes.Repeat([]byte("a record to compress\n"), 100)
+	zr, _ := zstd.NewReader(nil)
+	defer zr.Close()
+
+	for name, decode := range map[string]func([]byte) ([]byte, error){
+		CompressionSnappy: func(b []byte) ([]byte, error) { return snappy.Decode(nil, b) },
+		CompressionZstd:   func(b []byte) ([]byte, error) { return zr.DecodeAll(b, nil) },
+	} {
+		clt := &Client{
+			srv:  &Server{cfg: Config{Compression: name, MaxRecordSize: maxRecordSize}},
+			buff: pool.Get(),
+		}
+		clt.buff.Write(raw)
+		clt.appendBuff()
+
+		if len(clt.batch) != 1 || clt.batch[0].buff.Len() >= len(raw) {
+			t.Fatalf("%s: expected one compressed record, got %d", name, len(clt.batch))
+		}
+		b, err := decode(clt.batch[0].buff.B)
+		if err != nil || !bytes.Equal(b, raw) {
+			t.Errorf("%s: invalid record: %v", name, err)
+		}
+	}
+}
+
+func TestRecordLimitCompression(t *testing.T) {
+	for _, name := range []string{CompressionNone, CompressionGzip, CompressionSnappy, CompressionZstd} {
+		clt := &Client{srv: &Server{cfg: Config{Compression: name, MaxRecordSize: maxRecordSize}}}
+		limit := clt.recordLimit()
+		if c := compressor(name); c != nil && c.MaxLen(limit) > maxRecordSize {
+			t.Errorf("%s: %d bytes could be compressed to %d", name, limit, c.MaxLen(limit))
+		}
+		if limit <= 0 || limit > maxRecordSize {
+			t.Errorf("%s: invalid limit %d", name, limit)
+		}
+	}
+}
+
+// expander is a compressor that doesn't fulfill its MaxLen
+type expander struct{}
+
+func (expander) Compress(dst, data []byte) ([]byte, error) {
+	return append(append(dst, data...), data...), nil
+}
+
+func (expander) MaxLen(n int) int { return n }
+
+func TestRegisterCompressor(t *testing.T) {
+	RegisterCompressor("expander", expander{})
+	defer func() {
+		compressorsLock.Lock()
+		delete(compressors, "expander")
+		compressorsLock.Unlock()
+	}()
+
+	srv := newTestServer(1)
+	srv.cfg.Compression = "expander"
+	clt := &Client{srv: srv, buff: pool.Get()}
+
+	clt.buff.Write([]byte("ab"))
+	clt.appendBuff()
+	if len(clt.batch) != 1 || string(clt.batch[0].buff.B) != "abab" {
+		t.Fatalf("expected the registered compressor, got %d records", len(clt.batch))
+	}
+
+	// The compressed length is checked against the Firehose limit
+	clt.buff.Write(make([]byte, maxRecordSize/2+1))
+	clt.appendBuff()
+	if len(clt.batch) != 1 || srv.Stats().RecordsDropped != 1 {
+		t.Errorf("expected the record over the limit dropped, got %d dropped", srv.Stats().RecordsDropped)
+	}
+}
@@ -1,136 +1,712 @@
 package firehosePool
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
 )
 
 const (
 	connectionRetry         = 2 * time.Second
+	maxConnectionRetry      = 1 * time.Minute
 	connectTimeout          = 15 * time.Second
 	errorsFrame             = 10 * time.Second
 	maxErrors               = 10 // Limit of errors to restart the connection
 	limitIntervalConnection = 30 * time.Second
+	activePollInterval      = 500 * time.Millisecond // Wait between checks of the stream status with WaitForActive
 )
 
 func (srv *Server) _reload() {
+	var tries int
 	for range srv.chReload {
 		if srv.isExiting() {
 			continue
 		}
 
-		if err := srv.clientsReset(); err != nil {
-			log.Printf("Firehose ERROR: can't connect to kinesis: %s", err)
-			time.Sleep(connectionRetry)
+		if err := srv.reset(); err != nil {
+			srv.logf(LogError, "Firehose ERROR: can't connect to kinesis: %s", err)
+			select {
+			case <-srv.after(srv.backoff(tries)):
+			case <-srv.ctx.Done():
+				continue
+			}
+			tries++
+
+			// Escalate once per outage, the pool keeps trying
+			if cfg := srv.conf(); tries == cfg.MaxConnectionFailures && cfg.OnFatal != nil {
+				cfg.OnFatal(err)
+			}
+
+			// Try again, unless there is already a pending reload
+			srv.Lock()
+			if !srv.exiting.Load() {
+				select {
+				case srv.chReload <- true:
+				default:
+				}
+			}
+			srv.Unlock()
+			continue
 		}
+		tries = 0
+	}
+}
+
+// backoff returns the wait before the next connection try, it grows
+// exponentially with the consecutive failures up to MaxConnectionRetry
+// and half of it is random to avoid all the clients retrying at once
+func (srv *Server) backoff(tries int) time.Duration {
+	cfg := srv.conf()
+	d := cfg.ConnectionRetry
+	for i := 0; i < tries && d < cfg.MaxConnectionRetry; i++ {
+		d *= 2
 	}
+	if d > cfg.MaxConnectionRetry {
+		d = cfg.MaxConnectionRetry
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
 }
 
-func (srv *Server) failure() {
+func (srv *Server) failure(err error) {
 	if srv.isExiting() {
 		return
 	}
 
 	srv.Lock()
-	defer srv.Unlock()
 
-	if time.Now().Sub(srv.lastError) > errorsFrame {
+	if srv.now().Sub(srv.lastError) > srv.cfg.ErrorsFrame {
 		srv.errors = 0
 	}
 
 	srv.errors++
-	srv.lastError = time.Now()
-	log.Printf("Firehose: %d errors detected", srv.errors)
+	srv.lastError = srv.now()
+	srv.lastErr = err
+	srv.logf(LogWarn, "Firehose: %d errors detected", srv.errors)
+
+	if srv.errors <= int64(srv.cfg.MaxErrors) {
+		srv.Unlock()
+		return
+	}
 
-	if srv.errors > maxErrors {
+	// The connection and the credentials are created again with new clients,
+	// the pool is failing until a batch is sent
+	srv.setFailing(true)
+	srv.overErrors = true
+	srv.connected = false
+	srv.recycle = true
+	errs, fn := srv.errors, srv.cfg.OnThresholdExceeded
+	srv.Unlock()
+
+	if fn != nil {
+		fn(int(errs))
+	}
+	select {
+	case srv.chReload <- true:
+	default:
+	}
+}
+
+// erroring reports whether the pool is still failing because of the errors
+// over MaxErrors. It ends when a batch is sent or when the ErrorsFrame passed
+// without errors, a reload is programmed for then. It's called with the lock.
+func (srv *Server) erroring() bool {
+	if !srv.overErrors {
+		return false
+	}
+
+	wait := srv.cfg.ErrorsFrame - srv.now().Sub(srv.lastError)
+	if wait <= 0 {
+		srv.overErrors = false
+		return false
+	}
+
+	if !srv.framePending {
+		srv.framePending = true
+		srv.reloadAfter(srv.after(wait), func() { srv.framePending = false })
+	}
+	return true
+}
+
+// delivered ends the failing state of the errors over MaxErrors once a batch
+// or a record was accepted by the stream
+func (srv *Server) delivered() {
+	if !srv.failing.Load() {
+		return
+	}
+
+	srv.Lock()
+	defer srv.Unlock()
+	if srv.overErrors {
+		srv.overErrors = false
+		srv.setFailing(!srv.connected)
+	}
+}
+
+// reloadAfter sends a reload once ch fires unless the pool exits before, fn
+// is called with the lock just before
+func (srv *Server) reloadAfter(ch <-chan time.Time, fn func()) {
+	go func() {
 		select {
-		case srv.chReload <- true:
-		default:
+		case <-ch:
+		case <-srv.ctx.Done():
+			return
 		}
+		srv.Lock()
+		defer srv.Unlock()
+		fn()
+		if !srv.exiting.Load() {
+			select {
+			case srv.chReload <- true:
+			default:
+			}
+		}
+	}()
+}
+
+// rampDesired returns the clients to run, during the RampUp after the first
+// connection they grow linearly from one to cliDesired and a reload is
+// programmed for the next one. It's called with the lock.
+func (srv *Server) rampDesired() int {
+	if srv.rampStart.IsZero() || srv.cliDesired <= 1 {
+		return srv.cliDesired
+	}
+
+	elapsed := srv.now().Sub(srv.rampStart)
+	if elapsed >= srv.cfg.RampUp {
+		srv.rampStart = time.Time{}
+		return srv.cliDesired
+	}
+
+	if !srv.rampPending {
+		srv.rampPending = true
+		step := srv.cfg.RampUp / time.Duration(srv.cliDesired-1)
+		srv.reloadAfter(srv.after(step), func() { srv.rampPending = false })
 	}
+	return 1 + int(float64(srv.cliDesired-1)*float64(elapsed)/float64(srv.cfg.RampUp))
 }
 
-func (srv *Server) clientsReset() (err error) {
+// describe checks the stream is active with DescribeDeliveryStream and keeps
+// its ARN, type and encryption, it's called with the lock but it's released
+// while waiting with WaitForActive
+func (srv *Server) describe(ctx context.Context) error {
+	stream := &firehose.DescribeDeliveryStreamInput{
+		DeliveryStreamName: aws.String(srv.cfg.StreamName),
+	}
+
+	l, err := srv.awsSvc.DescribeDeliveryStream(ctx, stream, srv.cfg.RequestOptions...)
+	if err != nil {
+		err = classifyError(err)
+		srv.logf(LogError, "Firehose ERROR: describe stream: %s", err)
+		return err
+	}
+
+	srv.logf(LogDebug, "Firehose Connected to %s (%s) status %s",
+		*l.DeliveryStreamDescription.DeliveryStreamName,
+		*l.DeliveryStreamDescription.DeliveryStreamARN,
+		l.DeliveryStreamDescription.DeliveryStreamStatus)
+
+	// A stream just created is CREATING for a while, wait for it on startup.
+	// The lock is released meanwhile, the pool must be the same after it.
+	if l.DeliveryStreamDescription.DeliveryStreamStatus != types.DeliveryStreamStatusActive && srv.cfg.WaitForActive > 0 && srv.lastConnection.IsZero() {
+		srv.logf(LogInfo, "Firehose waiting up to %s for the stream %s to be active", srv.cfg.WaitForActive, srv.cfg.StreamName)
+		cfg, api := srv.cfg, srv.awsSvc
+		srv.Unlock()
+		l, err = waitForActive(srv.ctx, api, cfg, stream, l)
+		srv.Lock()
+		if err != nil {
+			err = classifyError(err)
+			srv.logf(LogError, "Firehose ERROR: describe stream: %s", err)
+			return err
+		}
+		if srv.exiting.Load() {
+			return ErrExiting
+		}
+		if !sameConnection(cfg, srv.cfg) {
+			return errConfigChanged
+		}
+	}
+
+	// Clients would fail sending to a stream that is not active, wait for it
+	if status := l.DeliveryStreamDescription.DeliveryStreamStatus; status != types.DeliveryStreamStatusActive {
+		return fmt.Errorf("%w: %s", ErrStreamNotActive, status)
+	}
+
+	srv.streamARN = *l.DeliveryStreamDescription.DeliveryStreamARN
+	srv.streamType = l.DeliveryStreamDescription.DeliveryStreamType
+	srv.destination = destinationType(l.DeliveryStreamDescription.Destinations)
+	srv.encryption = l.DeliveryStreamDescription.DeliveryStreamEncryptionConfiguration
+	if srv.cfg.RequireEncryption && (srv.encryption == nil || srv.encryption.Status != types.DeliveryStreamEncryptionStatusEnabled) {
+		srv.logf(LogError, "Firehose ERROR: the stream %s is not encrypted", srv.cfg.StreamName)
+		return ErrEncryptionRequired
+	}
+	return nil
+}
+
+// destinationType returns the type of the first destination, S3 is the last
+// option because the description of the other ones can include it
+func destinationType(destinations []types.DestinationDescription) string {
+	if len(destinations) == 0 {
+		return ""
+	}
+
+	d := destinations[0]
+	switch {
+	case d.RedshiftDestinationDescription != nil:
+		return DestinationRedshift
+	case d.ElasticsearchDestinationDescription != nil:
+		return DestinationElasticsearch
+	case d.AmazonopensearchserviceDestinationDescription != nil:
+		return DestinationOpenSearch
+	case d.AmazonOpenSearchServerlessDestinationDescription != nil:
+		return DestinationOpenSearchServerless
+	case d.SplunkDestinationDescription != nil:
+		return DestinationSplunk
+	case d.HttpEndpointDestinationDescription != nil:
+		return DestinationHTTPEndpoint
+	case d.SnowflakeDestinationDescription != nil:
+		return DestinationSnowflake
+	case d.IcebergDestinationDescription != nil:
+		return DestinationIceberg
+	case d.ExtendedS3DestinationDescription != nil, d.S3DestinationDescription != nil:
+		return DestinationS3
+	}
+	return ""
+}
+
+// verifyWrite checks the credentials can put records with a PutRecordBatch
+// without records. AWS authorizes the requests before validating them: a
+// principal without firehose:PutRecordBatch gets AccessDeniedException and an
+// allowed one a validation error of the empty list, nothing is written. The
+// order is not documented by AWS, the validation error is logged so it can be
+// checked. Other errors are returned, the connection is tried again.
+func (srv *Server) verifyWrite(ctx context.Context) error {
+	_, err := srv.awsSvc.PutRecordBatch(ctx, &firehose.PutRecordBatchInput{
+		DeliveryStreamName: aws.String(srv.cfg.StreamName),
+		Records:            []types.Record{},
+	}, srv.cfg.RequestOptions...)
+	if err == nil || isErrorValidation(err) {
+		srv.logf(LogDebug, "Firehose %s: PutRecordBatch allowed, the empty batch got: %v", srv.cfg.StreamName, err)
+		return nil
+	}
+	return classifyError(err)
+}
+
+// isErrorValidation reports whether the request was rejected because its
+// parameters are not valid
+func isErrorValidation(err error) bool {
+	var invalid *types.InvalidArgumentException
+	if errors.As(err, &invalid) {
+		return true
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "ValidationException", "ValidationError", "InvalidArgumentException":
+			return true
+		}
+	}
+	return false
+}
+
+// expire replaces the connection and the clients once they are older than
+// MaxConnectionAge
+func (srv *Server) expire() {
 	srv.Lock()
 	defer srv.Unlock()
 
-	if srv.errors == 0 && srv.lastConnection.Add(limitIntervalConnection).Before(time.Now()) {
-		log.Printf("Firehose Reload config to the stream %s", srv.cfg.StreamName)
+	srv.ageTimer = nil
+	if srv.exiting.Load() {
+		return
+	}
 
-		var sess *session.Session
+	srv.logf(LogDebug, "Firehose %s: connection older than %s, reconnecting", srv.cfg.StreamName, srv.cfg.MaxConnectionAge)
+	srv.expired = true
+	srv.recycle = true
+	select {
+	case srv.chReload <- true:
+	default:
+	}
+}
 
-		if srv.cfg.Profile != "" {
-			sess, err = session.NewSessionWithOptions(session.Options{
-				Profile:           srv.cfg.Profile,
-				SharedConfigState: session.SharedConfigEnable,
-			})
-		} else {
-			sess, err = session.NewSession()
-		}
+// refreshCredentials discards the cached credentials so the next request
+// retrieves new ones from the provider, without connecting again
+func (srv *Server) refreshCredentials() {
+	srv.Lock()
+	defer srv.Unlock()
 
-		if err != nil {
-			log.Printf("Firehose ERROR: session: %s", err)
+	if srv.credentials != nil {
+		srv.credentials.Invalidate()
+	}
+}
 
-			srv.errors++
-			srv.lastError = time.Now()
-			return err
+// batchFailure counts a PutRecordBatch rejected by the stream and returns
+// the wait before retrying, it's doubled for every error over MaxBatchErrors
+// in the frame but the connection is not restarted
+func (srv *Server) batchFailure() time.Duration {
+	srv.Lock()
+	defer srv.Unlock()
+
+	if srv.now().Sub(srv.lastBatchError) > srv.cfg.ErrorsFrame {
+		srv.batchErrors = 0
+	}
+
+	srv.batchErrors++
+	srv.lastBatchError = srv.now()
+
+	d := globalFailureWait
+	for i := int64(srv.cfg.MaxBatchErrors); i < srv.batchErrors && d < maxThrottleWait; i++ {
+		d *= 2
+	}
+	if d > maxThrottleWait {
+		d = maxThrottleWait
+	}
+	return d
+}
+
+// sameConnection reports whether both configs connect to the same stream
+// with the same settings
+func sameConnection(a, b Config) bool {
+	return a.StreamName == b.StreamName &&
+		a.Target == b.Target &&
+		a.Region == b.Region &&
+		a.Profile == b.Profile &&
+		a.CredentialsFile == b.CredentialsFile &&
+		a.Endpoint == b.Endpoint &&
+		a.FIPS == b.FIPS &&
+		a.DualStack == b.DualStack &&
+		a.RoleARN == b.RoleARN &&
+		a.ExternalID == b.ExternalID &&
+		a.UserAgent == b.UserAgent &&
+		a.AWSConfig == b.AWSConfig &&
+		a.DryRun == b.DryRun &&
+		a.RequireEncryption == b.RequireEncryption &&
+		a.SkipDescribe == b.SkipDescribe
+}
+
+// configRegion returns the region of the config, if it's empty the one of
+// AWS_DEFAULT_REGION that the SDK doesn't read. AWS_REGION has preference.
+func configRegion(region string) string {
+	if region != "" || os.Getenv("AWS_REGION") != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// loadConfig returns the AWS config of the pool, a copy of AWSConfig with
+// the settings of the config or a new one
+func (srv *Server) loadConfig(ctx context.Context) (aws.Config, error) {
+	if srv.cfg.AWSConfig != nil {
+		awsCfg := srv.cfg.AWSConfig.Copy()
+		if srv.cfg.Region != "" {
+			awsCfg.Region = srv.cfg.Region
+		}
+		if srv.cfg.Retryer != nil {
+			awsCfg.Retryer = srv.cfg.Retryer
 		}
+		return awsCfg, nil
+	}
+
+	// The HTTP client is bounded too, the SDK default has no timeout
+	httpClient := awshttp.NewBuildableClient().
+		WithTimeout(srv.cfg.ConnectTimeout).
+		WithDialerOptions(func(d *net.Dialer) {
+			d.Timeout = srv.cfg.ConnectTimeout
+		})
 
-		config := &aws.Config{Region: aws.String(srv.cfg.Region)}
+	opts := []func(*config.LoadOptions) error{
+		config.WithHTTPClient(httpClient),
+	}
+	// Without region the SDK resolves it from AWS_REGION and the profile
+	if region := configRegion(srv.cfg.Region); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	if srv.cfg.Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(srv.cfg.Profile))
+	}
+	if srv.cfg.CredentialsFile != "" {
+		opts = append(opts, config.WithSharedCredentialsFiles([]string{srv.cfg.CredentialsFile}))
+	}
+	if srv.cfg.Retryer != nil {
+		opts = append(opts, config.WithRetryer(srv.cfg.Retryer))
+	}
+
+	return config.LoadDefaultConfig(ctx, opts...)
+}
+
+// newAPI creates the Firehose client with the AWS settings of the config,
+// unless the config already has one
+func (srv *Server) newAPI(ctx context.Context) (API, error) {
+	if srv.cfg.FirehoseAPI != nil {
+		return srv.cfg.FirehoseAPI, nil
+	}
+
+	awsCfg, err := srv.loadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if awsCfg.Region == "" {
+		return nil, ErrNoRegion
+	}
+
+	if srv.cfg.RoleARN != "" {
+		stsClient := sts.NewFromConfig(awsCfg, func(o *sts.Options) {
+			o.EndpointOptions.UseFIPSEndpoint, o.EndpointOptions.UseDualStackEndpoint = srv.endpointStates()
+		})
+		provider := stscreds.NewAssumeRoleProvider(stsClient, srv.cfg.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			if srv.cfg.ExternalID != "" {
+				o.ExternalID = aws.String(srv.cfg.ExternalID)
+			}
+		})
+		awsCfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	srv.credentials, _ = awsCfg.Credentials.(*aws.CredentialsCache)
+
+	if srv.cfg.Target == TargetKinesis {
+		return &kinesisAPI{srv: srv, svc: kinesis.NewFromConfig(awsCfg, func(o *kinesis.Options) {
+			if srv.cfg.Endpoint != "" {
+				o.BaseEndpoint = aws.String(srv.cfg.Endpoint)
+			}
+			o.EndpointOptions.UseFIPSEndpoint, o.EndpointOptions.UseDualStackEndpoint = srv.endpointStates()
+			if srv.cfg.UserAgent != "" {
+				o.APIOptions = append(o.APIOptions, awsmiddleware.AddUserAgentKey(srv.cfg.UserAgent))
+			}
+		})}, nil
+	}
+
+	return firehose.NewFromConfig(awsCfg, func(o *firehose.Options) {
 		if srv.cfg.Endpoint != "" {
-			config.Endpoint = aws.String(srv.cfg.Endpoint)
+			o.BaseEndpoint = aws.String(srv.cfg.Endpoint)
+		}
+		o.EndpointOptions.UseFIPSEndpoint, o.EndpointOptions.UseDualStackEndpoint = srv.endpointStates()
+		if srv.cfg.EndpointResolver != nil {
+			o.EndpointResolverV2 = srv.cfg.EndpointResolver
 		}
+		if srv.cfg.UserAgent != "" {
+			o.APIOptions = append(o.APIOptions, awsmiddleware.AddUserAgentKey(srv.cfg.UserAgent))
+		}
+	}), nil
+}
 
-		srv.awsSvc = firehose.New(sess, config)
-		stream := &firehose.DescribeDeliveryStreamInput{
-			DeliveryStreamName: &srv.cfg.StreamName,
+// endpointStates returns the FIPS and DualStack settings for the endpoint
+// options of the SDK clients
+func (srv *Server) endpointStates() (aws.FIPSEndpointState, aws.DualStackEndpointState) {
+	fips, dualStack := aws.FIPSEndpointStateUnset, aws.DualStackEndpointStateUnset
+	if srv.cfg.FIPS {
+		fips = aws.FIPSEndpointStateEnabled
+	}
+	if srv.cfg.DualStack {
+		dualStack = aws.DualStackEndpointStateEnabled
+	}
+	return fips, dualStack
+}
+
+// reset runs clientsReset and then the OnConnect or OnReset callbacks,
+// they are called without holding the lock
+func (srv *Server) reset() error {
+	srv.Lock()
+	last := srv.lastConnection
+	srv.Unlock()
+
+	err := srv.clientsReset()
+
+	srv.Lock()
+	onConnect, onReset := srv.cfg.OnConnect, srv.cfg.OnReset
+	connected, arn := srv.lastConnection != last, srv.streamARN
+	srv.Unlock()
+
+	if err != nil {
+		if onReset != nil {
+			onReset(err)
 		}
+		return err
+	}
 
-		var l *firehose.DescribeDeliveryStreamOutput
-		l, err = srv.awsSvc.DescribeDeliveryStream(stream)
+	if connected && onConnect != nil {
+		onConnect(arn)
+	}
+	return nil
+}
+
+// errConfigChanged is returned when the connection settings changed while
+// waiting for the stream, the reload of the change connects again
+var errConfigChanged = errors.New("firehose config changed while connecting")
+
+// waitForActive describes the stream until it's active or WaitForActive
+// elapsed, it returns the last description. It's called without the lock,
+// with the config and the API of the connection.
+func waitForActive(ctx context.Context, api API, cfg Config, stream *firehose.DescribeDeliveryStreamInput, l *firehose.DescribeDeliveryStreamOutput) (*firehose.DescribeDeliveryStreamOutput, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.WaitForActive)
+	defer cancel()
+
+	t := time.NewTicker(activePollInterval)
+	defer t.Stop()
+
+	for l.DeliveryStreamDescription.DeliveryStreamStatus != types.DeliveryStreamStatusActive {
+		select {
+		case <-ctx.Done():
+			return l, nil
+		case <-t.C:
+		}
+
+		reqCtx, reqCancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
+		next, err := api.DescribeDeliveryStream(reqCtx, stream, cfg.RequestOptions...)
+		reqCancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return l, nil
+			}
+			return nil, err
+		}
+		l = next
+	}
+
+	return l, nil
+}
+
+func (srv *Server) clientsReset() (err error) {
+	srv.Lock()
+	defer srv.Unlock()
+
+	// Exit sets the flag with the lock, once it did no client is created
+	// because it could start after Exit waits for the running ones
+	if srv.exiting.Load() {
+		return ErrExiting
+	}
+
+	defer func() {
+		srv.setFailing(!srv.connected || srv.erroring())
+	}()
+
+	if srv.cfg.DryRun {
+		// Nothing is sent to AWS, there is no need to connect
+		if !srv.connected {
+			srv.logf(LogInfo, "Firehose DRY RUN: records to the stream %s won't be sent", srv.cfg.StreamName)
+			srv.connected = true
+			srv.lastConnection = srv.now()
+		}
+	} else if !srv.connected || srv.expired || (srv.errors == 0 && srv.lastConnection.Add(limitIntervalConnection).Before(srv.now())) {
+		srv.logf(LogDebug, "Firehose Reload config to the stream %s", srv.cfg.StreamName)
+
+		ctx, cancel := context.WithTimeout(srv.ctx, srv.cfg.ConnectTimeout)
+		defer cancel()
+
+		var api API
+		api, err = srv.newAPI(ctx)
 		if err != nil {
-			log.Printf("Firehose ERROR: describe stream: %s", err)
+			srv.logf(LogError, "Firehose ERROR: config: %s", err)
 
+			srv.connected = false
+			srv.errors++
+			srv.lastError = srv.now()
+			srv.lastErr = err
+			return err
+		}
+		srv.awsSvc = api
+
+		if srv.cfg.SkipDescribe {
+			// Nothing is known of the stream, PutRecordBatch will tell
+			srv.logf(LogDebug, "Firehose Connected to %s without describing it", srv.cfg.StreamName)
+			srv.streamARN, srv.streamType, srv.destination, srv.encryption = "", "", "", nil
+			if srv.cfg.RequireEncryption {
+				srv.logf(LogError, "Firehose ERROR: the encryption of the stream %s can't be checked with SkipDescribe", srv.cfg.StreamName)
+				err = ErrEncryptionRequired
+			}
+		} else {
+			err = srv.describe(ctx)
+		}
+		if err != nil {
+			srv.connected = false
 			srv.errors++
-			srv.lastError = time.Now()
+			srv.lastError = srv.now()
+			srv.lastErr = err
 			return err
 		}
 
-		log.Printf("Firehose Connected to %s (%s) status %s",
-			*l.DeliveryStreamDescription.DeliveryStreamName,
-			*l.DeliveryStreamDescription.DeliveryStreamARN,
-			*l.DeliveryStreamDescription.DeliveryStreamStatus)
+		if srv.cfg.VerifyWrite {
+			if err = srv.verifyWrite(ctx); err != nil {
+				srv.logf(LogError, "Firehose ERROR: the stream %s is not writable: %s", srv.cfg.StreamName, err)
+
+				srv.connected = false
+				srv.errors++
+				srv.lastError = srv.now()
+				srv.lastErr = err
+				return err
+			}
+		}
+
+		if srv.cfg.RampUp > 0 && srv.lastConnection.IsZero() {
+			srv.rampStart = srv.now()
+		}
 
-		srv.lastConnection = time.Now()
+		srv.connected = true
+		srv.lastConnection = srv.now()
 		srv.errors = 0
+
+		// The timer starts with the clients created for a new connection
+		srv.expired = false
+		if srv.cfg.MaxConnectionAge > 0 && srv.ageTimer == nil {
+			srv.ageTimer = time.AfterFunc(srv.cfg.MaxConnectionAge, srv.expire)
+		}
 	}
 
 	defer func() {
-		log.Printf("Firehose %s clients %d, in the queue %d/%d", srv.cfg.StreamName, len(srv.clients), len(srv.C), cap(srv.C))
+		srv.setWorkers(srv.clients)
+		srv.logf(LogDebug, "Firehose %s clients %d, in the queue %d/%d", srv.cfg.StreamName, len(srv.clients), srv.QueueLen(), srv.QueueCap())
 	}()
 
+	// Clients send to the connection they were created with, a new stream
+	// or a connection restarted by errors require new clients. While paused
+	// the clients are not replaced nor removed, Resume reloads.
+	paused := srv.Paused()
+	if srv.recycle && (!paused || len(srv.clients) == 0) {
+		if len(srv.clients) > 0 {
+			atomic.AddInt64(&srv.stats.Resets, 1)
+		}
+		for _, c := range srv.clients {
+			c.stop()
+			go c.Exit() // Don't block waiting for the client to flush
+		}
+		srv.clients = nil
+		srv.recycle = false
+	}
+
 	currClients := len(srv.clients)
+	desired := srv.rampDesired()
 
 	// No changes in the number of clients
-	if currClients == srv.cliDesired {
+	if currClients == desired || (currClients > desired && paused) {
 		return nil
 	}
 
-	// If the config define lower number than the active clients remove the difference
-	if currClients > srv.cliDesired {
-		toExit := currClients - srv.cliDesired
-		for i := 0; i < toExit; i++ {
-			go srv.clients[0].Exit() // Don't block waiting for the client to flush
-			srv.clients[0] = nil
-			srv.clients = srv.clients[1:]
+	// If the config define lower number than the active clients remove the
+	// newest ones, the slice is truncated once they were told to exit
+	if currClients > desired {
+		for i, c := range srv.clients[desired:] {
+			c.stop()
+			go c.Exit() // Don't block waiting for the client to flush
+			srv.clients[desired+i] = nil
 		}
+		srv.clients = srv.clients[:desired]
 	} else {
 		// If the config define higher number than the active clients start new clients
-		for i := currClients; i < srv.cliDesired; i++ {
+		for i := currClients; i < desired; i++ {
 			srv.clients = append(srv.clients, NewClient(srv))
 		}
 	}
@@ -0,0 +1,1162 @@
+package firehosePool
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/aws/smithy-go"
+	smithyendpoints "github.com/aws/smithy-go/endpoints"
+)
+
+// fakeAPI replies to the pool requests without AWS
+type fakeAPI struct {
+	mu           sync.Mutex // Several clients can send at once
+	status       types.DeliveryStreamStatus
+	encryption   *types.DeliveryStreamEncryptionConfiguration
+	destinations []types.DestinationDescription
+	put          func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error)
+	calls        int
+	hang         bool // PutRecordBatch waits for the context instead of calling put
+
+	activeAfter int    // DescribeDeliveryStream calls before the status changes to ACTIVE
+	missing     string // Stream that doesn't exist
+	describes   int
+	options     int // Request options of the last call
+}
+
+func (f *fakeAPI) DescribeDeliveryStream(ctx context.Context, in *firehose.DescribeDeliveryStreamInput, optFns ...func(*firehose.Options)) (*firehose.DescribeDeliveryStreamOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.describes++
+	f.options = len(optFns)
+	if *in.DeliveryStreamName == f.missing {
+		return nil, &types.ResourceNotFoundException{}
+	}
+	if f.activeAfter > 0 && f.describes > f.activeAfter {
+		f.status = types.DeliveryStreamStatusActive
+	}
+	return &firehose.DescribeDeliveryStreamOutput{
+		DeliveryStreamDescription: &types.DeliveryStreamDescription{
+			DeliveryStreamName:   in.DeliveryStreamName,
+			DeliveryStreamARN:    aws.String("arn:aws:firehose:eu-west-1:123456789012:deliverystream/" + *in.DeliveryStreamName),
+			DeliveryStreamStatus: f.status,
+			DeliveryStreamType:   types.DeliveryStreamTypeDirectPut,
+
+			DeliveryStreamEncryptionConfiguration: f.encryption,
+			Destinations:                          f.destinations,
+		},
+	}, nil
+}
+
+func (f *fakeAPI) PutRecordBatch(ctx context.Context, in *firehose.PutRecordBatchInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error) {
+	f.mu.Lock()
+	f.calls++
+	f.options = len(optFns)
+	f.mu.Unlock()
+	if f.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return f.put(in)
+}
+
+func (f *fakeAPI) PutRecord(ctx context.Context, in *firehose.PutRecordInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordOutput, error) {
+	f.mu.Lock()
+	f.calls++
+	f.options = len(optFns)
+	f.mu.Unlock()
+	out, err := f.put(&firehose.PutRecordBatchInput{DeliveryStreamName: in.DeliveryStreamName, Records: []types.Record{*in.Record}})
+	if err != nil {
+		return nil, err
+	}
+	return &firehose.PutRecordOutput{RecordId: out.RequestResponses[0].RecordId}, nil
+}
+
+func TestBackoff(t *testing.T) {
+	srv := &Server{cfg: Config{
+		ConnectionRetry:    time.Second,
+		MaxConnectionRetry: 10 * time.Second,
+	}}
+
+	for tries, max := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		max *= time.Second
+		for i := 0; i < 100; i++ {
+			if d := srv.backoff(tries); d < max/2 || d > max {
+				t.Fatalf("try %d: backoff %s out of [%s, %s]", tries, d, max/2, max)
+			}
+		}
+	}
+}
+
+func TestSameConnection(t *testing.T) {
+	a := Config{StreamName: "stream", Region: "eu-west-1", MaxWorkers: 2}
+
+	b := a
+	b.MaxWorkers = 10
+	if !sameConnection(a, b) {
+		t.Error("the number of workers doesn't change the connection")
+	}
+
+	b.StreamName = "other"
+	if sameConnection(a, b) {
+		t.Error("a new stream requires a new connection")
+	}
+}
+
+func TestBatchFailure(t *testing.T) {
+	srv := &Server{cfg: Config{ErrorsFrame: time.Minute, MaxBatchErrors: 2}}
+
+	for i := 0; i < 2; i++ {
+		if d := srv.batchFailure(); d != globalFailureWait {
+			t.Errorf("expected %s under the limit, got %s", globalFailureWait, d)
+		}
+	}
+	if d := srv.batchFailure(); d != 2*globalFailureWait {
+		t.Errorf("expected %s over the limit, got %s", 2*globalFailureWait, d)
+	}
+	if srv.errors != 0 {
+		t.Errorf("batch errors must not count as connection errors")
+	}
+}
+
+func TestClientsResetFakeAPI(t *testing.T) {
+	fake := &fakeAPI{status: types.DeliveryStreamStatusCreating}
+	srv := newTestServer(1)
+	srv.cfg.StreamName = "test"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.FirehoseAPI = fake
+
+	if err := srv.clientsReset(); !errors.Is(err, ErrStreamNotActive) {
+		t.Errorf("expected %s, got %v", ErrStreamNotActive, err)
+	}
+	if srv.connected {
+		t.Errorf("must not be connected to a stream that is not active")
+	}
+
+	fake.status = types.DeliveryStreamStatusActive
+	if err := srv.clientsReset(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if !srv.connected || srv.awsSvc != fake {
+		t.Errorf("expected connected with the fake client")
+	}
+	if arn := srv.StreamARN(); arn != "arn:aws:firehose:eu-west-1:123456789012:deliverystream/test" {
+		t.Errorf("unexpected stream ARN %q", arn)
+	}
+	if st := srv.DeliveryStreamType(); st != types.DeliveryStreamTypeDirectPut {
+		t.Errorf("unexpected stream type %q", st)
+	}
+}
+
+func TestClientsResetWaitForActive(t *testing.T) {
+	fake := &fakeAPI{status: types.DeliveryStreamStatusCreating, activeAfter: 2}
+	srv := newTestServer(1)
+	srv.cfg.StreamName = "test"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.FirehoseAPI = fake
+	srv.cfg.WaitForActive = 10 * time.Millisecond
+
+	// It times out before the stream is active
+	if err := srv.clientsReset(); !errors.Is(err, ErrStreamNotActive) {
+		t.Errorf("expected %s, got %v", ErrStreamNotActive, err)
+	}
+
+	srv.cfg.WaitForActive = 5 * time.Second
+	connected := make(chan error, 1)
+	go func() { connected <- srv.clientsReset() }()
+
+	// The pool is not locked while waiting
+	time.Sleep(10 * time.Millisecond)
+	status := make(chan Status, 1)
+	go func() { status <- srv.Status() }()
+	select {
+	case st := <-status:
+		if st.Connected {
+			t.Errorf("unexpected connection before the stream is active")
+		}
+	case <-time.After(activePollInterval / 2):
+		t.Errorf("Status blocked while waiting for the stream")
+	}
+
+	if err := <-connected; err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if !srv.connected || fake.describes != 3 {
+		t.Errorf("expected connected after 3 describes, got %v after %d", srv.connected, fake.describes)
+	}
+
+	// A new stream while waiting requires connecting again
+	fake.status, fake.activeAfter, fake.describes = types.DeliveryStreamStatusCreating, 2, 0
+	srv.lastConnection, srv.connected = time.Time{}, false
+	go func() { connected <- srv.clientsReset() }()
+	time.Sleep(10 * time.Millisecond)
+	srv.Lock()
+	srv.cfg.StreamName = "other"
+	srv.Unlock()
+	if err := <-connected; err != errConfigChanged {
+		t.Errorf("expected %s, got %v", errConfigChanged, err)
+	}
+}
+
+func TestNewAPIRetryer(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.Region = "eu-west-1"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.Retryer = func() aws.Retryer { return aws.NopRetryer{} }
+
+	api, err := srv.newAPI(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if r := api.(*firehose.Client).Options().Retryer; r.MaxAttempts() != 1 {
+		t.Errorf("expected the SDK retries disabled, got %d attempts", r.MaxAttempts())
+	}
+}
+
+// endpointResolver returns the endpoint of the parameters it got
+type endpointResolver struct{}
+
+func (endpointResolver) ResolveEndpoint(ctx context.Context, p firehose.EndpointParameters) (smithyendpoints.Endpoint, error) {
+	host := "firehose." + aws.ToString(p.Region) + ".example.com"
+	if aws.ToBool(p.UseFIPS) {
+		host = "fips." + host
+	}
+	u, err := url.Parse("https://" + host)
+	return smithyendpoints.Endpoint{URI: *u}, err
+}
+
+func TestNewAPIEndpoint(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.Region = "us-gov-west-1"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.FIPS = true
+	srv.cfg.DualStack = true
+	srv.cfg.EndpointResolver = endpointResolver{}
+
+	api, err := srv.newAPI(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	o := api.(*firehose.Client).Options()
+	if o.EndpointOptions.UseFIPSEndpoint != aws.FIPSEndpointStateEnabled || o.EndpointOptions.UseDualStackEndpoint != aws.DualStackEndpointStateEnabled {
+		t.Errorf("expected FIPS and dual-stack enabled, got %+v", o.EndpointOptions)
+	}
+
+	e, err := o.EndpointResolverV2.ResolveEndpoint(context.Background(), firehose.EndpointParameters{Region: aws.String(o.Region), UseFIPS: aws.Bool(true)})
+	if err != nil || e.URI.Host != "fips.firehose.us-gov-west-1.example.com" {
+		t.Errorf("expected the custom resolver, got %s: %v", e.URI.Host, err)
+	}
+}
+
+func TestNewAPIUserAgent(t *testing.T) {
+	agent := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agent <- r.Header.Get("User-Agent")
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"DeliveryStreamDescription":{"DeliveryStreamName":"test"}}`))
+	}))
+	defer ts.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	srv := newTestServer(1)
+	srv.cfg.Region = "eu-west-1"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.Endpoint = ts.URL
+	srv.cfg.UserAgent = "orders-service"
+
+	api, err := srv.newAPI(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := api.DescribeDeliveryStream(context.Background(), &firehose.DescribeDeliveryStreamInput{DeliveryStreamName: aws.String("test")}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ua := <-agent; !strings.Contains(ua, "orders-service") {
+		t.Errorf("expected the custom user agent, got %q", ua)
+	}
+}
+
+func TestNewAPIShared(t *testing.T) {
+	httpClient := awshttp.NewBuildableClient()
+	shared := aws.Config{Region: "us-east-1", HTTPClient: httpClient}
+
+	srv := newTestServer(1)
+	srv.cfg.Region = "eu-west-1"
+	srv.cfg.AWSConfig = &shared
+
+	api, err := srv.newAPI(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	o := api.(*firehose.Client).Options()
+	if o.HTTPClient != httpClient || o.Region != "eu-west-1" {
+		t.Errorf("expected the shared HTTP client in eu-west-1, got %s", o.Region)
+	}
+	if shared.Region != "us-east-1" {
+		t.Errorf("the shared config must not be modified")
+	}
+}
+
+func TestNewAPICredentialsFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "credentials")
+	if err := os.WriteFile(file, []byte("[test]\naws_access_key_id = AKIDTEST\naws_secret_access_key = secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	srv := newTestServer(1)
+	srv.cfg.Region = "eu-west-1"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.Profile = "test"
+	srv.cfg.CredentialsFile = file
+
+	api, err := srv.newAPI(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	creds, err := api.(*firehose.Client).Options().Credentials.Retrieve(context.Background())
+	if err != nil || creds.AccessKeyID != "AKIDTEST" {
+		t.Errorf("expected the credentials of the file, got %q: %v", creds.AccessKeyID, err)
+	}
+}
+
+func TestConfigRegion(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "eu-west-1")
+
+	if r := configRegion("us-east-1"); r != "us-east-1" {
+		t.Errorf("expected the configured region, got %q", r)
+	}
+	if r := configRegion(""); r != "eu-west-1" {
+		t.Errorf("expected AWS_DEFAULT_REGION, got %q", r)
+	}
+
+	// The SDK reads AWS_REGION
+	t.Setenv("AWS_REGION", "eu-central-1")
+	if r := configRegion(""); r != "" {
+		t.Errorf("expected the region resolved by the SDK, got %q", r)
+	}
+}
+
+func TestClientsResetRequireEncryption(t *testing.T) {
+	fake := &fakeAPI{status: types.DeliveryStreamStatusActive}
+	srv := newTestServer(1)
+	srv.cfg.StreamName = "test"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.FirehoseAPI = fake
+	srv.cfg.RequireEncryption = true
+
+	if err := srv.clientsReset(); err != ErrEncryptionRequired {
+		t.Errorf("expected %s, got %v", ErrEncryptionRequired, err)
+	}
+
+	fake.encryption = &types.DeliveryStreamEncryptionConfiguration{
+		KeyType: types.KeyTypeAwsOwnedCmk,
+		Status:  types.DeliveryStreamEncryptionStatusEnabled,
+	}
+	if err := srv.clientsReset(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if e := srv.Encryption(); e == nil || e.KeyType != types.KeyTypeAwsOwnedCmk {
+		t.Errorf("unexpected encryption %+v", e)
+	}
+}
+
+func TestClientsResetVerifyWrite(t *testing.T) {
+	var reply error
+	fake := &fakeAPI{status: types.DeliveryStreamStatusActive, put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+		if len(in.Records) != 0 {
+			t.Errorf("expected no records, got %d", len(in.Records))
+		}
+		return nil, reply
+	}}
+	srv := newTestServer(1)
+	srv.cfg.StreamName = "test"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.FirehoseAPI = fake
+	srv.cfg.VerifyWrite = true
+
+	reply = &smithy.GenericAPIError{Code: "AccessDeniedException"}
+	if err := srv.clientsReset(); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("expected %s, got %v", ErrAccessDenied, err)
+	}
+
+	// Other errors don't tell whether it's writable
+	reply = &types.ServiceUnavailableException{}
+	if err := srv.clientsReset(); !errors.Is(err, ErrThrottled) {
+		t.Errorf("expected %s, got %v", ErrThrottled, err)
+	}
+
+	reply = &types.InvalidArgumentException{}
+	if err := srv.clientsReset(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if fake.calls != 3 {
+		t.Errorf("expected 3 PutRecordBatch calls, got %d", fake.calls)
+	}
+}
+
+func TestVerifyWriteErrors(t *testing.T) {
+	// The errors of an empty batch as Firehose replies them
+	var reply string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(reply))
+	}))
+	defer ts.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	srv := newTestServer(1)
+	srv.cfg.StreamName = "test"
+	srv.cfg.Region = "eu-west-1"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.Endpoint = ts.URL
+	srv.cfg.Retryer = func() aws.Retryer { return aws.NopRetryer{} }
+
+	api, err := srv.newAPI(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	srv.awsSvc = api
+
+	for _, c := range []struct {
+		reply string
+		want  error
+	}{
+		{`{"__type":"com.amazon.coral.validate#ValidationException","message":"1 validation error detected: Value '[]' at 'records' failed to satisfy constraint: Member must have length greater than or equal to 1"}`, nil},
+		{`{"__type":"InvalidArgumentException","message":"Records size is less than 1"}`, nil},
+		{`{"__type":"AccessDeniedException","Message":"User: arn:aws:iam::123456789012:user/test is not authorized to perform: firehose:PutRecordBatch"}`, ErrAccessDenied},
+		{`{"__type":"ResourceNotFoundException","message":"Firehose test not found"}`, ErrStreamNotFound},
+	} {
+		reply = c.reply
+		if err := srv.verifyWrite(context.Background()); c.want == nil && err != nil || !errors.Is(err, c.want) {
+			t.Errorf("expected %v for %s, got %v", c.want, c.reply, err)
+		}
+	}
+}
+
+func TestRequestOptions(t *testing.T) {
+	fake := &fakeAPI{status: types.DeliveryStreamStatusActive, put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+		return &firehose.PutRecordBatchOutput{
+			FailedPutCount:   aws.Int32(0),
+			RequestResponses: make([]types.PutRecordBatchResponseEntry, len(in.Records)),
+		}, nil
+	}}
+	srv := newTestServer(1)
+	srv.cfg.StreamName = "test"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.BatchTimeout = time.Second
+	srv.cfg.FirehoseAPI = fake
+	srv.cfg.RequestOptions = []func(*firehose.Options){
+		func(o *firehose.Options) {},
+		func(o *firehose.Options) {},
+	}
+
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fake.options != 2 {
+		t.Errorf("expected 2 options in DescribeDeliveryStream, got %d", fake.options)
+	}
+
+	fake.options = 0
+	clt := &Client{
+		srv:  srv,
+		api:  fake,
+		buff: pool.Get(),
+		t:    time.NewTimer(time.Minute),
+	}
+	clt.buff.Write([]byte("record\n"))
+	clt.appendBuff()
+	if err := clt.flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fake.options != 2 {
+		t.Errorf("expected 2 options in PutRecordBatch, got %d", fake.options)
+	}
+}
+
+func TestDestinationType(t *testing.T) {
+	fake := &fakeAPI{status: types.DeliveryStreamStatusActive, destinations: []types.DestinationDescription{{
+		RedshiftDestinationDescription: &types.RedshiftDestinationDescription{},
+		S3DestinationDescription:       &types.S3DestinationDescription{},
+	}}}
+	srv := newTestServer(1)
+	srv.cfg.StreamName = "test"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.FirehoseAPI = fake
+
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d := srv.DestinationType(); d != DestinationRedshift {
+		t.Errorf("expected %s, got %q", DestinationRedshift, d)
+	}
+
+	// It's refreshed on reconnect
+	fake.destinations = []types.DestinationDescription{{ExtendedS3DestinationDescription: &types.ExtendedS3DestinationDescription{}}}
+	srv.connected = false
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d := srv.DestinationType(); d != DestinationS3 {
+		t.Errorf("expected %s, got %q", DestinationS3, d)
+	}
+
+	if d := destinationType(nil); d != "" {
+		t.Errorf("expected no destination, got %q", d)
+	}
+}
+
+func TestClientsResetSkipDescribe(t *testing.T) {
+	fake := &fakeAPI{missing: "test"}
+	srv := newTestServer(1)
+	srv.cfg.StreamName = "test"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.FirehoseAPI = fake
+	srv.cfg.SkipDescribe = true
+	srv.cfg.RequireEncryption = true
+
+	// The encryption can't be checked without describing the stream
+	if err := srv.clientsReset(); err != ErrEncryptionRequired {
+		t.Errorf("expected %s, got %v", ErrEncryptionRequired, err)
+	}
+
+	srv.cfg.RequireEncryption = false
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !srv.connected || fake.describes != 0 || srv.StreamARN() != "" {
+		t.Errorf("expected connected without describing, got %d describes and ARN %q", fake.describes, srv.StreamARN())
+	}
+}
+
+func TestResetCallbacks(t *testing.T) {
+	fake := &fakeAPI{status: types.DeliveryStreamStatusCreating}
+	srv := newTestServer(1)
+	srv.cfg.StreamName = "test"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.FirehoseAPI = fake
+
+	var arn string
+	var resetErr error
+	srv.cfg.OnConnect = func(streamARN string) {
+		// The lock is not held
+		srv.Status()
+		arn = streamARN
+	}
+	srv.cfg.OnReset = func(err error) { resetErr = err }
+
+	if err := srv.reset(); !errors.Is(resetErr, ErrStreamNotActive) || err != resetErr {
+		t.Errorf("expected OnReset with %s, got %v", ErrStreamNotActive, resetErr)
+	}
+
+	fake.status = types.DeliveryStreamStatusActive
+	if err := srv.reset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.HasSuffix(arn, "/test") {
+		t.Errorf("expected OnConnect with the stream ARN, got %q", arn)
+	}
+
+	// Already connected, no new connection
+	arn = ""
+	srv.reset()
+	if arn != "" {
+		t.Errorf("OnConnect called without a new connection")
+	}
+}
+
+func TestConnectResetOnce(t *testing.T) {
+	for _, missing := range []string{"", "test"} {
+		// The stream is created meanwhile, the lock isn't held while waiting
+		fake := &fakeAPI{status: types.DeliveryStreamStatusCreating, activeAfter: 1, missing: missing}
+		var connects, resets int32
+		srv, err := Connect(context.Background(), Config{
+			StreamName:     "test",
+			ConnectTimeout: 5 * time.Second,
+			WaitForActive:  5 * time.Second,
+			FirehoseAPI:    fake,
+			OnConnect:      func(string) { atomic.AddInt32(&connects, 1) },
+			OnReset:        func(error) { atomic.AddInt32(&resets, 1) },
+		})
+		if srv != nil {
+			srv.Exit()
+		}
+		if (err != nil) != (missing != "") {
+			t.Errorf("missing %q: unexpected error %v", missing, err)
+		}
+
+		// The background loop doesn't connect again meanwhile, the stream
+		// is described until it's active
+		want := 2
+		if missing != "" {
+			want = 1
+		}
+		fake.mu.Lock()
+		describes := fake.describes
+		fake.mu.Unlock()
+		if n := atomic.LoadInt32(&connects) + atomic.LoadInt32(&resets); n != 1 || describes != want {
+			t.Errorf("missing %q: expected one connection, got %d callbacks and %d describes", missing, n, describes)
+		}
+	}
+}
+
+func TestReloadRecycleClients(t *testing.T) {
+	var streams []string
+	fake := &fakeAPI{
+		status: types.DeliveryStreamStatusActive,
+		put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+			streams = append(streams, *in.DeliveryStreamName)
+			return &firehose.PutRecordBatchOutput{
+				FailedPutCount:   aws.Int32(0),
+				RequestResponses: make([]types.PutRecordBatchResponseEntry, len(in.Records)),
+			}, nil
+		},
+	}
+	cfg := Config{
+		StreamName:  "old",
+		MinWorkers:  1,
+		MaxWorkers:  1,
+		FirehoseAPI: fake,
+	}
+	srv := newTestServer(10)
+	srv.Reload(&cfg)
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	old := srv.clients[0]
+
+	srv.C <- []byte("first")
+	if err := srv.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cfg.StreamName = "new"
+	srv.Reload(&cfg)
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(srv.clients) != 1 || srv.clients[0] == old {
+		t.Fatalf("expected the client replaced after changing the stream")
+	}
+
+	srv.C <- []byte("second")
+	if err := srv.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(streams) != 2 || streams[0] != "old" || streams[1] != "new" {
+		t.Errorf("expected the records sent to old and new, got %v", streams)
+	}
+}
+
+func TestReloadWhileSending(t *testing.T) {
+	fake := &fakeAPI{
+		status: types.DeliveryStreamStatusActive,
+		put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+			return &firehose.PutRecordBatchOutput{
+				FailedPutCount:   aws.Int32(0),
+				RequestResponses: make([]types.PutRecordBatchResponseEntry, len(in.Records)),
+			}, nil
+		},
+	}
+	cfg := Config{StreamName: "test", MinWorkers: 2, MaxWorkers: 2, FlushInterval: time.Millisecond, FirehoseAPI: fake}
+	srv := newTestServer(10)
+	srv.Reload(&cfg)
+	defer srv.Exit()
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Run with -race: the running clients read the config while it's
+	// replaced by Reload
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c := cfg
+			c.FlushInterval = time.Duration(1+i%3) * time.Millisecond
+			c.MaxRecords = 1 + i%5
+			if i%2 == 0 {
+				c.Framing = FramingNone
+			}
+			srv.Reload(&c)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var n int64
+	for sending := true; sending; n++ {
+		select {
+		case <-done:
+			sending = false
+		default:
+		}
+		if err := srv.SendWithContext(context.Background(), []byte("record")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if err := srv.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if sent := srv.Stats().RecordsSent; sent != n {
+		t.Errorf("expected %d records sent, got %d", n, sent)
+	}
+}
+
+func TestSwitchStream(t *testing.T) {
+	var streams []string
+	fake := &fakeAPI{
+		status:  types.DeliveryStreamStatusActive,
+		missing: "missing",
+		put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+			streams = append(streams, *in.DeliveryStreamName)
+			return &firehose.PutRecordBatchOutput{
+				FailedPutCount:   aws.Int32(0),
+				RequestResponses: make([]types.PutRecordBatchResponseEntry, len(in.Records)),
+			}, nil
+		},
+	}
+	srv := newTestServer(10)
+	srv.Reload(&Config{StreamName: "blue", MinWorkers: 1, MaxWorkers: 1, FirehoseAPI: fake})
+	defer srv.Exit()
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	srv.C <- []byte("first")
+	if err := srv.SwitchStream(context.Background(), "green"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := srv.SwitchStream(context.Background(), "missing"); !errors.Is(err, ErrStreamNotFound) {
+		t.Errorf("expected %s, got %v", ErrStreamNotFound, err)
+	}
+
+	// The reload goes back to the stream that works
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	srv.C <- []byte("second")
+	if err := srv.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(streams) != 2 || streams[0] != "blue" || streams[1] != "green" {
+		t.Errorf("expected the records sent to blue and green, got %v", streams)
+	}
+	if arn := srv.StreamARN(); !strings.HasSuffix(arn, "/green") {
+		t.Errorf("expected the ARN of green, got %s", arn)
+	}
+}
+
+func TestSwitchStreamConcurrent(t *testing.T) {
+	fake := &fakeAPI{
+		status: types.DeliveryStreamStatusActive,
+		put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+			return &firehose.PutRecordBatchOutput{
+				FailedPutCount:   aws.Int32(0),
+				RequestResponses: make([]types.PutRecordBatchResponseEntry, len(in.Records)),
+			}, nil
+		},
+	}
+	srv := newTestServer(10)
+	srv.Reload(&Config{StreamName: "blue", MinWorkers: 1, MaxWorkers: 1, FlushInterval: time.Millisecond, FirehoseAPI: fake})
+	defer srv.Exit()
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Run with -race: the stream is read by the clients, the logs and the
+	// calls without the buffer while it's switched
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			srv.SendWithContext(context.Background(), []byte("record"))
+			srv.SendNow(context.Background(), []byte("now"))
+			srv.SendBatch(context.Background(), [][]byte{[]byte("batch")})
+			srv.Status()
+		}
+	}()
+
+	for _, name := range []string{"green", "blue", "green"} {
+		if err := srv.SwitchStream(context.Background(), name); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestClientsResetExiting(t *testing.T) {
+	srv := newTestServer(10)
+	srv.Reload(&Config{StreamName: "test", MinWorkers: 1, MaxWorkers: 1, FlushTimeout: time.Second, FirehoseAPI: &fakeAPI{status: types.DeliveryStreamStatusActive}})
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	srv.Exit()
+
+	// No clients are created once Exit waits for the running ones
+	srv.Lock()
+	srv.recycle = true
+	srv.Unlock()
+	if err := srv.clientsReset(); err != ErrExiting {
+		t.Errorf("expected %s, got %v", ErrExiting, err)
+	}
+	select {
+	case <-srv.chExited:
+	case <-time.After(time.Second):
+		t.Fatalf("the clients didn't exit")
+	}
+	if n := srv.Stats().ActiveClients; n != 0 {
+		t.Errorf("expected no clients running, got %d", n)
+	}
+}
+
+func TestClientsResetShrink(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		sent int
+	)
+	fake := &fakeAPI{
+		status: types.DeliveryStreamStatusActive,
+		put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+			mu.Lock()
+			sent += len(in.Records)
+			mu.Unlock()
+			return &firehose.PutRecordBatchOutput{
+				FailedPutCount:   aws.Int32(0),
+				RequestResponses: make([]types.PutRecordBatchResponseEntry, len(in.Records)),
+			}, nil
+		},
+	}
+	cfg := Config{
+		StreamName:    "test",
+		MinWorkers:    3,
+		MaxWorkers:    3,
+		FlushInterval: time.Minute,
+		FirehoseAPI:   fake,
+	}
+	srv := newTestServer(10)
+	srv.Reload(&cfg)
+	defer srv.Exit()
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	const records = 300
+	for i := 0; i < records; i++ {
+		if err := srv.SendWithContext(context.Background(), []byte("record")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// Like the autoscaling, Reload would race with the running clients
+	srv.Lock()
+	srv.cliDesired = 1
+	srv.Unlock()
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(srv.clients) != 1 {
+		t.Fatalf("expected 1 client, got %d", len(srv.clients))
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if err := srv.Flush(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		mu.Lock()
+		n := sent
+		mu.Unlock()
+		if n == records {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sent != records {
+		t.Errorf("expected %d records sent, got %d", records, sent)
+	}
+	if s := srv.Stats(); s.RecordsDropped != 0 {
+		t.Errorf("expected no records dropped, got %d", s.RecordsDropped)
+	}
+}
+
+func TestClientsResetShrinkTail(t *testing.T) {
+	cfg := Config{
+		StreamName:  "test",
+		MinWorkers:  10,
+		MaxWorkers:  10,
+		FirehoseAPI: &fakeAPI{status: types.DeliveryStreamStatusActive},
+	}
+	srv := newTestServer(10)
+	srv.Reload(&cfg)
+	defer srv.Exit()
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	before := append([]*Client(nil), srv.clients...)
+
+	srv.Lock()
+	srv.cliDesired = 3
+	srv.Unlock()
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(srv.clients) != 3 {
+		t.Fatalf("expected 3 clients, got %d", len(srv.clients))
+	}
+	stopped := 0
+	for i, c := range before {
+		c.cLock.RLock()
+		if c.stopped {
+			stopped++
+		}
+		if i < 3 && (c.stopped || srv.clients[i] != c) {
+			t.Errorf("expected the client %d to keep running", c.ID)
+		}
+		c.cLock.RUnlock()
+	}
+	if stopped != 7 {
+		t.Errorf("expected 7 clients exited, got %d", stopped)
+	}
+	if workers, _ := srv.workers.Load().([]*Client); len(workers) != 3 {
+		t.Errorf("expected 3 workers, got %d", len(workers))
+	}
+}
+
+func TestClientsResetRampUp(t *testing.T) {
+	clock := newFakeClock()
+	cfg := Config{
+		StreamName:  "test",
+		MinWorkers:  5,
+		MaxWorkers:  5,
+		RampUp:      4 * time.Second,
+		FirehoseAPI: &fakeAPI{status: types.DeliveryStreamStatusActive},
+	}
+	srv := newTestServer(10)
+	srv.clock = clock
+	srv.Reload(&cfg)
+	defer srv.Exit()
+	<-srv.chReload
+
+	reset := func(expected int) {
+		t.Helper()
+		if err := srv.clientsReset(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(srv.clients) != expected {
+			t.Errorf("expected %d clients, got %d", expected, len(srv.clients))
+		}
+	}
+
+	reset(1)
+	if d := <-clock.waits; d != time.Second {
+		t.Errorf("expected the next client in 1s, got %s", d)
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-srv.chReload:
+	case <-time.After(time.Second):
+		t.Fatalf("expected a reload for the next client")
+	}
+	reset(2)
+
+	clock.Advance(3 * time.Second)
+	reset(5)
+
+	// Only the first connection is ramped up
+	srv.Lock()
+	srv.connected = false
+	srv.recycle = true
+	srv.Unlock()
+	reset(5)
+}
+
+func TestReloadWorkers(t *testing.T) {
+	srv := newTestServer(1)
+	for _, c := range []struct{ min, max, desired int }{
+		{0, -1, 1},
+		{3, 2, 3},
+		{2, 2, 2},
+	} {
+		srv.Reload(&Config{StreamName: "test", MinWorkers: c.min, MaxWorkers: c.max, DryRun: true})
+		if srv.cliDesired != c.desired {
+			t.Errorf("workers %d/%d: expected %d clients, got %d", c.min, c.max, c.desired, srv.cliDesired)
+		}
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	fake := &fakeAPI{status: types.DeliveryStreamStatusCreating}
+	srv := newTestServer(1)
+	srv.cfg.StreamName = "test"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.FirehoseAPI = fake
+	srv.cfg.FailFast = true
+
+	srv.clientsReset()
+	if err := srv.SendWithContext(context.Background(), []byte("record")); err != ErrPoolFailing {
+		t.Errorf("expected %s, got %v", ErrPoolFailing, err)
+	}
+
+	fake.status = types.DeliveryStreamStatusActive
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := srv.SendWithContext(context.Background(), []byte("record")); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestFailFastErrors(t *testing.T) {
+	clock := newFakeClock()
+	fake := &fakeAPI{status: types.DeliveryStreamStatusActive}
+	srv := newTestServer(1)
+	srv.clock = clock
+	srv.cfg.StreamName = "test"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.FirehoseAPI = fake
+	srv.cfg.FailFast = true
+	srv.cfg.ErrorsFrame = time.Minute
+	srv.cfg.MaxErrors = 1
+
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Connecting again doesn't end it, the stream may still reject batches
+	for i := 0; i < 2; i++ {
+		srv.failure(errors.New("failed"))
+	}
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := srv.Send([]byte("record")); err != ErrPoolFailing {
+		t.Errorf("expected %s after too many errors, got %v", ErrPoolFailing, err)
+	}
+
+	// A record sent ends it
+	fake.put = func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+		return &firehose.PutRecordBatchOutput{
+			FailedPutCount:   aws.Int32(0),
+			RequestResponses: []types.PutRecordBatchResponseEntry{{RecordId: aws.String("1")}},
+		}, nil
+	}
+	if err := srv.SendNow(context.Background(), []byte("record")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := srv.Send([]byte("record")); err != nil {
+		t.Errorf("unexpected error once a record was sent: %s", err)
+	}
+	<-srv.C
+
+	// So does an ErrorsFrame without errors
+	for i := 0; i < 2; i++ {
+		srv.failure(errors.New("failed"))
+	}
+	srv.clientsReset()
+	<-srv.chReload
+	clock.Advance(time.Minute)
+	select {
+	case <-srv.chReload:
+	case <-time.After(time.Second):
+		t.Fatalf("expected a reload at the end of the frame")
+	}
+	srv.clientsReset()
+	if err := srv.Send([]byte("record")); err != nil {
+		t.Errorf("unexpected error after the frame: %s", err)
+	}
+}
+
+func TestMaxConnectionAge(t *testing.T) {
+	fake := &fakeAPI{status: types.DeliveryStreamStatusActive}
+	srv := newTestServer(1)
+	srv.cfg.StreamName = "test"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.FlushTimeout = time.Second
+	srv.cfg.FirehoseAPI = fake
+	srv.cfg.MaxConnectionAge = 10 * time.Millisecond
+	srv.cliDesired = 1
+	defer srv.Exit()
+
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	old := srv.clients[0]
+
+	select {
+	case <-srv.chReload:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the connection didn't expire")
+	}
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fake.describes != 2 || len(srv.clients) != 1 || srv.clients[0] == old {
+		t.Errorf("expected a new connection and client, got %d describes", fake.describes)
+	}
+}
+
+func TestFailureThresholdExceeded(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.ErrorsFrame = time.Minute
+	srv.cfg.MaxErrors = 2
+	srv.connected = true
+
+	var calls []int
+	srv.cfg.OnThresholdExceeded = func(errors int) {
+		if !srv.TryLock() {
+			t.Errorf("OnThresholdExceeded called with the lock held")
+		} else {
+			srv.Unlock()
+		}
+		calls = append(calls, errors)
+	}
+
+	for i := 0; i < 3; i++ {
+		srv.failure(errors.New("failed"))
+	}
+	if len(calls) != 1 || calls[0] != 3 {
+		t.Errorf("expected one call with 3 errors, got %v", calls)
+	}
+	if len(srv.chReload) != 1 {
+		t.Errorf("expected a reload after the threshold")
+	}
+	if srv.connected || !srv.recycle {
+		t.Errorf("expected a new connection and clients after the threshold")
+	}
+}
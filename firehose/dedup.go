@@ -0,0 +1,56 @@
+package firehosePool
+
+import (
+	"container/list"
+	"hash/maphash"
+)
+
+// dedupSeed is the seed of the default HashFunc
+var dedupSeed = maphash.MakeSeed()
+
+// dedup remembers the hashes of the last records of a client, the least
+// recently seen is forgotten once there are DedupWindow of them
+type dedup struct {
+	size  int
+	items map[uint64]*list.Element
+	order *list.List // Front is the most recent
+}
+
+func newDedup(size int) *dedup {
+	return &dedup{
+		size:  size,
+		items: make(map[uint64]*list.Element, size),
+		order: list.New(),
+	}
+}
+
+// seen reports whether the hash is in the window, it's the most recent then
+func (d *dedup) seen(h uint64) bool {
+	e, ok := d.items[h]
+	if ok {
+		d.order.MoveToFront(e)
+	}
+	return ok
+}
+
+// add puts the hash in the window as the most recent one
+func (d *dedup) add(h uint64) {
+	if d.seen(h) {
+		return
+	}
+
+	d.items[h] = d.order.PushFront(h)
+	if d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.items, oldest.Value.(uint64))
+	}
+}
+
+// hash returns the hash of the record for DedupWindow
+func (clt *Client) hash(r []byte) uint64 {
+	if clt.srv.conf().HashFunc != nil {
+		return clt.srv.conf().HashFunc(r)
+	}
+	return maphash.Bytes(dedupSeed, r)
+}
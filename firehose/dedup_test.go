@@ -0,0 +1,78 @@
+package firehosePool
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDedupSeen(t *testing.T) {
+	d := newDedup(2)
+	for _, c := range []struct {
+		h    uint64
+		seen bool
+	}{
+		{1, false},
+		{2, false},
+		{1, true},  // 1 is the most recent now
+		{3, false}, // 2 is forgotten
+		{1, true},
+		{2, false},
+		{3, false},
+	} {
+		if seen := d.seen(c.h); seen != c.seen {
+			t.Errorf("expected %d seen %v, got %v", c.h, c.seen, seen)
+		}
+		d.add(c.h)
+	}
+	if len(d.items) != 2 || d.order.Len() != 2 {
+		t.Errorf("expected 2 hashes, got %d", len(d.items))
+	}
+}
+
+func TestProcessDedup(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.FlushSize = maxBatchSize
+	srv.cfg.MaxRecords = defaultMaxRecords
+	srv.cfg.HashFunc = func(b []byte) uint64 { return uint64(b[0]) } // The key is the first byte
+	var results []error
+	clt := &Client{
+		srv:   srv,
+		buff:  pool.Get(),
+		t:     time.NewTimer(time.Minute),
+		dedup: newDedup(10),
+	}
+
+	for _, r := range []string{"a1", "b1", "a2"} {
+		clt.process(&callbackRecord{record: []byte(r), fn: func(err error) { results = append(results, err) }})
+	}
+	clt.appendBuff()
+
+	if s := srv.Stats(); s.RecordsDeduped != 1 {
+		t.Errorf("expected 1 record deduplicated, got %d", s.RecordsDeduped)
+	}
+	if len(results) != 1 || results[0] != ErrDuplicate {
+		t.Errorf("expected the callback of the duplicate called with %s, got %v", ErrDuplicate, results)
+	}
+	if len(clt.batch) != 2 || string(clt.batch[0].buff.B) != "a1\n" || string(clt.batch[1].buff.B) != "b1\n" {
+		t.Errorf("expected a1 and b1 in the batch, got %d records", len(clt.batch))
+	}
+
+	// A record discarded by Transform is not remembered
+	results = nil
+	srv.cfg.Transform = func(b []byte) ([]byte, error) {
+		if b[1] == 'x' {
+			return nil, errors.New("invalid")
+		}
+		return b, nil
+	}
+	for _, r := range []string{"cx", "c1"} {
+		clt.process(&callbackRecord{record: []byte(r), fn: func(err error) { results = append(results, err) }})
+	}
+	if len(results) != 1 || results[0] == nil || results[0] == ErrDuplicate {
+		t.Errorf("expected only the Transform error, got %v", results)
+	}
+	if s := srv.Stats(); s.RecordsDeduped != 1 {
+		t.Errorf("expected 1 record deduplicated, got %d", s.RecordsDeduped)
+	}
+}
@@ -0,0 +1,85 @@
+package firehosePool
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket shared by the clients of the pool, the bucket
+// holds up to one second of tokens. The zero value doesn't limit.
+type limiter struct {
+	sync.Mutex
+	rate   float64 // Tokens per second, zero is unlimited
+	tokens float64
+	last   time.Time
+}
+
+// setRate changes the tokens per second, zero or less disables the limit
+func (l *limiter) setRate(rate float64) {
+	l.Lock()
+	defer l.Unlock()
+
+	if rate < 0 {
+		rate = 0
+	}
+	if rate != l.rate {
+		l.rate = rate
+		l.tokens = rate
+		l.last = time.Now()
+	}
+}
+
+// reserve takes n tokens and returns the wait until they are available,
+// the tokens can go negative so requests over the rate are not starved
+func (l *limiter) reserve(n float64) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.rate == 0 {
+		return 0
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	l.tokens -= n
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// limit waits for the quota of one PutRecordBatch or PutRecord call with n
+// records, it returns the error of the context if it's done before
+func (srv *Server) limit(ctx context.Context, n int) error {
+	if err := srv.batchLimit.wait(ctx, 1); err != nil {
+		return err
+	}
+	return srv.recordLimit.wait(ctx, float64(n))
+}
+
+// wait blocks until n tokens are available or the context is done, then
+// the tokens are given back and the error of the context returned
+func (l *limiter) wait(ctx context.Context, n float64) error {
+	d := l.reserve(n)
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.Lock()
+		l.tokens += n
+		l.Unlock()
+		return ctx.Err()
+	}
+}
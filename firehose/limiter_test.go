@@ -0,0 +1,45 @@
+package firehosePool
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	var l limiter
+	if d := l.reserve(1000); d != 0 {
+		t.Errorf("the zero limiter must not wait, got %s", d)
+	}
+
+	l.setRate(10)
+	if d := l.reserve(10); d != 0 {
+		t.Errorf("expected no wait within the burst, got %s", d)
+	}
+	if d := l.reserve(5); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("expected a wait of about 500ms, got %s", d)
+	}
+}
+
+func TestLimiterWaitContext(t *testing.T) {
+	var l limiter
+	l.setRate(1)
+	if err := l.wait(context.Background(), 1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.wait(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("the wait must end with the context, it took %s", d)
+	}
+
+	// The tokens of the cancelled wait are given back
+	if d := l.reserve(0); d > 0 {
+		t.Errorf("expected no debt after the cancelled wait, got %s", d)
+	}
+}
@@ -0,0 +1,29 @@
+package firehosePool
+
+// Log levels, every level includes the messages of the previous ones
+const (
+	LogError = "error" // Failures, e.g. records lost or a connection that failed
+	LogWarn  = "warn"  // Problems that are retried, e.g. throttling or partial failures
+	LogInfo  = "info"  // Changes of the pool that are not routine
+	LogDebug = "debug" // Routine messages, e.g. every connection and client
+)
+
+var logLevels = map[string]int32{
+	LogError: 1,
+	LogWarn:  2,
+	LogInfo:  3,
+	LogDebug: 4,
+}
+
+// logf logs the message if the level is in LogLevel, info until the config
+// is loaded
+func (srv *Server) logf(level string, format string, v ...interface{}) {
+	max := srv.logLevel.Load()
+	if max == 0 {
+		max = logLevels[LogInfo]
+	}
+	if logLevels[level] > max {
+		return
+	}
+	srv.conf().Logger.Printf(format, v...)
+}
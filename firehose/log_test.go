@@ -0,0 +1,42 @@
+package firehosePool
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// logBuffer keeps the messages logged
+type logBuffer struct {
+	lines []string
+}
+
+func (l *logBuffer) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestLogLevel(t *testing.T) {
+	for _, c := range []struct {
+		level string
+		want  int
+	}{
+		{"", 3},
+		{LogError, 1},
+		{LogWarn, 2},
+		{LogDebug, 4},
+		{"verbose", 3},
+	} {
+		l := &logBuffer{}
+		srv := newTestServer(1)
+		srv.Reload(&Config{StreamName: "test", DryRun: true, Logger: l, LogLevel: c.level})
+		l.lines = nil
+
+		srv.logf(LogError, "error")
+		srv.logf(LogWarn, "warn")
+		srv.logf(LogInfo, "info")
+		srv.logf(LogDebug, "debug")
+		if len(l.lines) != c.want {
+			t.Errorf("level %q: expected %d messages, got %s", c.level, c.want, strings.Join(l.lines, ","))
+		}
+	}
+}
@@ -1,13 +1,20 @@
 package firehosePool
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"log"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
 	"github.com/gabrielperezs/monad"
+	compress "github.com/gallir/smart-relayer/redis"
 )
 
 const (
@@ -17,81 +24,494 @@ const (
 	defaultMaxRecords      = 500
 	defaultThresholdWarmUp = 0.6
 	defaultCoolDownPeriod  = 15 * time.Second
+	defaultFlushInterval   = recordsTimeout
+	defaultFlushSize       = maxBatchSize
+	defaultFlushTimeout    = 30 * time.Second
+	flushPollInterval      = 10 * time.Millisecond
 )
 
+// Compression algorithms applied to every Firehose record
+const (
+	CompressionNone   = "none"
+	CompressionGzip   = "gzip"
+	CompressionSnappy = "snappy" // Snappy block format, not the framed one
+	CompressionZstd   = "zstd"
+)
+
+// Framing of the records in a Firehose record
+const (
+	FramingNewline        = "newline"         // Newline terminated, unless they already end with it
+	FramingLengthPrefixed = "length-prefixed" // Prefixed with their length, see Deaggregate
+	FramingNone           = "none"            // Sent as they are, every record in its own Firehose record
+)
+
+// Overflow policies when the buffer is full
+const (
+	OverflowBlock      = "block"       // Send waits for room in the buffer
+	OverflowDropNewest = "drop-newest" // The new record is discarded
+	OverflowDropOldest = "drop-oldest" // The oldest record of the buffers, shared or of the workers, is discarded to make room
+)
+
+// Destinations of a delivery stream returned by DestinationType
+const (
+	DestinationS3                   = "s3"
+	DestinationRedshift             = "redshift"
+	DestinationElasticsearch        = "elasticsearch"
+	DestinationOpenSearch           = "opensearch"
+	DestinationOpenSearchServerless = "opensearch-serverless"
+	DestinationSplunk               = "splunk"
+	DestinationHTTPEndpoint         = "http-endpoint"
+	DestinationSnowflake            = "snowflake"
+	DestinationIceberg              = "iceberg"
+)
+
+var (
+	// ErrExiting is returned when sending records to a pool that is exiting
+	ErrExiting = errors.New("firehose pool is exiting")
+	// ErrRecordTooLarge is returned when a record doesn't fit in a Firehose record
+	ErrRecordTooLarge = errors.New("firehose record too large")
+	// ErrRetryLimit is reported when a failed record is not retried because
+	// there are too many records being retried
+	ErrRetryLimit = errors.New("firehose retry limit reached")
+	// ErrTooManyAttempts is reported when a record was rejected by Firehose
+	// too many times
+	ErrTooManyAttempts = errors.New("firehose record rejected too many times")
+	// ErrBufferFull is returned when MaxBufferedBytes is reached and
+	// BufferFullError is set
+	ErrBufferFull = errors.New("firehose buffer full")
+	// ErrNoRegion is returned when the region is not in the config, the
+	// environment or the AWS profile
+	ErrNoRegion = errors.New("firehose AWS region not configured")
+	// ErrEncryptionRequired is returned when RequireEncryption is set and the
+	// server-side encryption of the stream is not enabled
+	ErrEncryptionRequired = errors.New("firehose stream is not encrypted")
+	// ErrAccessDenied is returned when VerifyWrite is set and the
+	// credentials are not allowed to put records in the stream
+	ErrAccessDenied = errors.New("firehose access denied")
+	// ErrStreamNotFound is returned when the delivery stream doesn't exist
+	ErrStreamNotFound = errors.New("firehose stream not found")
+	// ErrThrottled is returned when Firehose throttled the requests
+	ErrThrottled = errors.New("firehose requests throttled")
+	// ErrCredentials is returned when the AWS credentials couldn't be
+	// retrieved, they expired or they are not valid
+	ErrCredentials = errors.New("firehose AWS credentials not valid")
+	// ErrStreamNotActive is returned when the delivery stream exists but its
+	// status is not ACTIVE yet
+	ErrStreamNotActive = errors.New("firehose stream is not active")
+	// ErrPoolFailing is returned by Send with FailFast while the pool can't
+	// connect to the stream or after too many errors until it sends again
+	ErrPoolFailing = errors.New("firehose pool is failing")
+	// ErrNotConnected is returned by SendNow before the pool connected
+	ErrNotConnected = errors.New("firehose pool is not connected")
+	// ErrBatchTimeout is reported when a PutRecordBatch call didn't finish
+	// in BatchTimeout
+	ErrBatchTimeout = errors.New("firehose PutRecordBatch timed out")
+	// ErrPaused is returned by Flush and SendNow while the pool is paused
+	ErrPaused = errors.New("firehose pool is paused")
+	// ErrDuplicate is reported to the callback of a record skipped because a
+	// copy was added to a batch within DedupWindow, the copy has its own result
+	ErrDuplicate = errors.New("firehose record duplicated")
+)
+
+// FailedRecord is a record discarded by the pool, Data is the record
+// compressed and framed as it was going to be sent to Firehose and Err the
+// reason why it was discarded. A record rejected by Transform is encoded
+// without the transformation and one rejected by Serializer has no Data.
+type FailedRecord struct {
+	Data []byte
+	Err  error
+}
+
+// BatchInfo describes a PutRecordBatch call for the BatchHook
+type BatchInfo struct {
+	Stream   string
+	Records  int // Firehose records, they contain several records when ConcatRecords is set
+	Bytes    int
+	Contexts []context.Context // Contexts given to Send of the records in the batch, only their values are used
+}
+
+// BatchHook is called before every PutRecordBatch call, the request is done
+// with the returned context and end is called with the result. failed is
+// the number of Firehose records rejected, all of them if err is not nil.
+type BatchHook func(ctx context.Context, b BatchInfo) (_ context.Context, end func(failed int, err error))
+
+// API is the part of the Firehose client used by the pool, it's satisfied
+// by *firehose.Client
+type API interface {
+	DescribeDeliveryStream(ctx context.Context, params *firehose.DescribeDeliveryStreamInput, optFns ...func(*firehose.Options)) (*firehose.DescribeDeliveryStreamOutput, error)
+	PutRecordBatch(ctx context.Context, params *firehose.PutRecordBatchInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error)
+	PutRecord(ctx context.Context, params *firehose.PutRecordInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordOutput, error)
+}
+
+// Logger is the interface used by the pool to report its activity, it's
+// satisfied by *log.Logger
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+var defaultLogger Logger = log.New(os.Stderr, "", log.LstdFlags)
+
 // Config is the general configuration for the server
 type Config struct {
 	// Internal clients details
-	MinWorkers      int
-	MaxWorkers      int
-	ThresholdWarmUp float64
-	Interval        time.Duration
-	CoolDownPeriod  time.Duration
-	Critical        bool // Handle this stream as critical
+	MinWorkers      int           // Clients running when the buffer is idle
+	MaxWorkers      int           // Clients running under pressure, if it's not over MinWorkers they are fixed
+	ThresholdWarmUp float64       // Fraction of the buffer in use that starts a new client
+	Interval        time.Duration // Interval to check the buffer usage
+	CoolDownPeriod  time.Duration // Time with low usage before stopping a client
+	Critical        bool          // Handle this stream as critical
+	MaxRetries      int           // Times a record rejected by Firehose or in a failed call is sent again before dropping it, 3 by default and negative never retries. Throttled calls, connection failures and failed calls of a Critical stream don't count
 	Serializer      func(i interface{}) ([]byte, error)
+	Marshal         func(v interface{}) ([]byte, error) // Used by SendValue in the goroutine of the caller, json.Marshal by default
+	Transform       func(b []byte) ([]byte, error)      // Applied to every record before adding it to the batch
+	DedupWindow     int                                 // Records remembered by every client to skip the exact duplicates with ErrDuplicate, 0 disables it
+	HashFunc        func(b []byte) uint64               // Hash of the records for DedupWindow, e.g. of a key instead of the whole record
+	DryRun          bool                                // Process the records as usual but don't send them to AWS
 
 	// Limits
-	Buffer        int
-	ConcatRecords bool // Contact many rows in one firehose record
-	MaxRecords    int  // To send in batch to Kinesis
-	Compress      bool // Compress records with snappy
+	Buffer         int                     // Records in the shared buffer, every client also buffers up to WorkerQueueSize records
+	MaxRecordSize  int                     // Max size of a record including the newline, it can't be over the Firehose limit of 1000 KB
+	SplitFunc      func(b []byte) [][]byte // Splits the []byte records over MaxRecordSize instead of rejecting them, SplitLines by default
+	ConcatRecords  bool                    // Contact many rows in one firehose record, every row is newline terminated
+	Aggregate      bool                    // Concat many records in one Firehose record, every record is prefixed with its length, see Deaggregate
+	Framing        string                  // Delimiter of the records: newline, length-prefixed or none for binary records, newline by default and length-prefixed with Aggregate
+	MaxRecords     int                     // To send in batch to Kinesis
+	FlushSize      int                     // Bytes accumulated before sending a batch, capped to the PutRecordBatch limit
+	AdaptiveFlush  bool                    // Shrink the batches and wait between them while Firehose rejects records, grow back to FlushSize when it doesn't
+	FlushInterval  time.Duration           // Max time to wait before sending a partial batch
+	MaxRecordAge   time.Duration           // Max time a record waits in the client before sending it, 0 is only FlushInterval
+	FlushTimeout   time.Duration           // Max time to wait for the pending records to be sent on exit
+	Compress       bool                    // Compress records with snappy
+	Compression    string                  // Compression of every Firehose record before sending it: none, gzip, snappy, zstd or a registered one
+	SkipCompressed bool                    // With gzip Compression, gzipped records are sent as they are in their own Firehose record
+
+	MaxBatchesPerSecond float64 // PutRecordBatch calls per second of all the clients, 0 is unlimited
+	MaxInFlightBatches  int     // PutRecordBatch calls of a client at the same time, it fills the next batch meanwhile. 1 by default, a Reload applies it to the clients created after it
+	MaxRecordsPerSecond float64 // Firehose records per second of all the clients, 0 is unlimited
+
+	// Records buffered by every client besides the shared Buffer, 128 by
+	// default and negative for none. MaxBufferedBytes counts the records of
+	// all the buffers, Send waits for whichever limit is reached first.
+	WorkerQueueSize int
+
+	// The records that are not []byte, sent with SendWithContext and a
+	// Serializer, count 0 bytes until a client serializes them: Send doesn't
+	// wait for MaxBufferedBytes with them and the limit can be exceeded
+	// meanwhile. The Buffer and the WorkerQueueSize still limit them.
+	MaxBufferedBytes int  // Max bytes of the records accepted but not sent yet, 0 is unlimited
+	BufferFullError  bool // Return ErrBufferFull instead of blocking when MaxBufferedBytes is reached
+	FailFast         bool // Return ErrPoolFailing instead of buffering while the pool can't connect to the stream or it's over MaxErrors
+
+	// What Send does when the buffer or MaxBufferedBytes is full: block,
+	// drop-newest or drop-oldest. The dropped records are discarded with
+	// ErrBufferFull and Send doesn't return an error.
+	OverflowPolicy string
+
+	// Picks the client of the []byte records, the ones with the same key go
+	// to the same client while the number of clients doesn't change and its
+	// buffer isn't full, so they keep their order. Round-robin when nil.
+	ShardKey func([]byte) uint32
+
+	// Directory of the write ahead log of the []byte records, they are sent
+	// again when a pool is created with the same directory. It's only read
+	// when the pool is created. The records dropped with ErrExiting stay in
+	// the spool, they are reported to ErrChan too. The spool can't keep
+	// records over the Firehose limit, with Compress they are rejected with
+	// ErrRecordTooLarge even if they would fit once compressed.
+	SpoolDir string
+
+	// Type of the stream: firehose, or kinesis for a Kinesis data stream
+	// written with PutRecords. Firehose by default. The records sent to
+	// Kinesis have no delimiter unless Framing or Aggregate are set.
+	Target string
+
+	// Partition key of every record with the kinesis Target, the murmur3
+	// hash of the record by default
+	PartitionKey func(b []byte) string
 
 	// Authentication and enpoints
-	StreamName string // Kinesis/Firehose stream name
-	Region     string // AWS region
-	Profile    string // AWS Profile name
-	Endpoint   string // AWS endpoint
+	StreamName      string // Kinesis/Firehose stream name
+	Region          string // AWS region, by default AWS_REGION, AWS_DEFAULT_REGION or the one of the profile
+	Profile         string // AWS Profile name
+	CredentialsFile string // Shared credentials file with the profile instead of ~/.aws/credentials
+	Endpoint        string // AWS endpoint, e.g. http://localhost:4566 for LocalStack
+	FIPS            bool   // Use the FIPS endpoints of Firehose and STS
+	DualStack       bool   // Use the dual-stack (IPv4 and IPv6) endpoints of Firehose and STS
+	RoleARN         string // AWS role to assume with the profile or default credentials
+	ExternalID      string // External ID used to assume the role
+	UserAgent       string // Added to the User-Agent of the Firehose requests, e.g. the name of the service
+
+	RequireEncryption bool // Fail to connect if the server-side encryption of the stream is not enabled
+	SkipDescribe      bool // Don't call DescribeDeliveryStream on connect, for policies that only allow PutRecordBatch
+	VerifyWrite       bool // Fail to connect if a PutRecordBatch without records is denied or fails for other reason than the empty list
+
+	FirehoseAPI API // Used instead of a client created with the AWS settings, e.g. a fake for tests
+
+	// Shared by several pools instead of loading a new one, with its
+	// credentials and HTTP client. Profile, CredentialsFile and ConnectTimeout don't apply
+	// to it, Region, RoleARN, Endpoint and Retryer do.
+	AWSConfig *aws.Config
 
-	OnFHError func(e error)
+	// Resolves the Firehose endpoint instead of the one of the SDK, it gets
+	// Region, Endpoint, FIPS and DualStack in the parameters. It doesn't
+	// apply to the kinesis Target.
+	EndpointResolver firehose.EndpointResolverV2
+
+	// Applied to every Firehose call of the pool, e.g. to add headers with a
+	// middleware in APIOptions. They don't apply to the kinesis Target.
+	RequestOptions []func(*firehose.Options)
+
+	// Retries of the SDK under the ones of the pool, by default the SDK
+	// standard retryer. aws.NopRetryer disables them.
+	Retryer func() aws.Retryer
+
+	// Connection, the defaults are used for zero values
+	ConnectionRetry    time.Duration // Wait before retrying a failed connection, it's doubled on every failure
+	MaxConnectionRetry time.Duration // Max wait before retrying a failed connection
+	ConnectTimeout     time.Duration // Timeout of the requests to AWS and of the HTTP client
+	BatchTimeout       time.Duration // Timeout of every PutRecordBatch call, ConnectTimeout by default, the HTTP client still stops it at ConnectTimeout
+	WaitForActive      time.Duration // Wait on startup for a stream that is not active yet, e.g. CREATING, instead of failing
+	ErrorsFrame        time.Duration // Time frame to count the errors
+	MaxErrors          int           // Connection errors in the frame that restart the connection
+	MaxBatchErrors     int           // Batches rejected by the stream in the frame before increasing the wait
+
+	MaxConnectionFailures int           // Consecutive failed connection tries before calling OnFatal, 0 never calls it
+	MaxConnectionAge      time.Duration // Connect again and replace the clients after this time, 0 keeps the connection
+	RampUp                time.Duration // Start the clients gradually over this time after the first connection, 0 starts all of them at once
+
+	OnFHError           func(e error)
+	OnConnect           func(streamARN string) // Called after connecting to the stream
+	OnReset             func(err error)        // Called when connecting to the stream failed, before retrying
+	OnFatal             func(err error)        // Called after MaxConnectionFailures, the pool keeps trying to connect
+	OnThresholdExceeded func(errors int)       // Called with the errors when they are over MaxErrors, before reconnecting
+	ErrChan             chan<- FailedRecord    // Optional channel to receive the discarded records, it must be buffered
+	OnDrop              func(data []byte)      // Called with every discarded record, data is only valid during the call
+	BatchHook           BatchHook              // Called around every PutRecordBatch call, e.g. to trace them
+	Logger              Logger                 // Destination of the log messages, the standard logger by default
+	LogLevel            string                 // Most verbose messages that are logged: error, warn, info or debug, info by default
 }
 
 type Server struct {
 	sync.Mutex
 
 	cfg        Config
+	config     atomic.Pointer[Config] // Copy of cfg for the readers without the lock
 	C          chan interface{}
 	clients    []*Client
 	cliDesired int
+	workers    atomic.Value // []*Client that take records directly from Send
+	next       uint64       // Round-robin position in workers
 
 	monad *monad.Monad
 
-	chReload chan bool
-	chDone   chan bool
-	exiting  bool
+	chReload  chan bool
+	chDone    chan bool
+	chExited  chan struct{}  // Closed once the pool and all its clients finished
+	running   sync.WaitGroup // Client goroutines running
+	chLock    sync.RWMutex   // Avoid sending to C while it's being closed
+	closeOnce sync.Once
+	exiting   atomic.Bool
+	failing   atomic.Bool  // The last connection failed or there were too many errors
+	paused    atomic.Value // chan struct{} closed by Resume, nil while running
+
+	failingSince int64 // Unix nanoseconds when the pool started failing
+	failingTime  int64 // Nanoseconds failing of the outages that finished
+	logLevel     atomic.Int32
+	ctx          context.Context
+	cancel       context.CancelFunc
 
-	awsSvc         *firehose.Firehose
+	awsSvc         API
+	credentials    *aws.CredentialsCache
+	encryption     *types.DeliveryStreamEncryptionConfiguration
+	streamARN      string
+	streamType     types.DeliveryStreamType
+	destination    string
+	connected      bool
+	recycle        bool        // The clients must be replaced after connecting
+	overErrors     bool        // The errors went over MaxErrors and no batch was sent since
+	framePending   bool        // A reload is programmed for the end of the ErrorsFrame
+	expired        bool        // The connection is older than MaxConnectionAge
+	ageTimer       *time.Timer // Expires the connection after MaxConnectionAge
+	rampStart      time.Time   // First connection while the clients are started with RampUp
+	rampPending    bool        // A reload is programmed for the next client of the ramp
 	lastConnection time.Time
 	lastError      time.Time
+	lastErr        error
+	batchErrors    int64 // Batches rejected by the stream in the frame
+	lastBatchError time.Time
 	errors         int64
+
+	clock    clock // Time of the error frames and connection retries, the real one if nil
+	spool    *spool
+	buffered int64         // Bytes of the records accepted but not sent yet
+	space    chan struct{} // Signaled when buffered bytes are released
+
+	batchLimit  limiter
+	recordLimit limiter
+
+	stats        Stats
+	latency      histogram
+	batchRecords histogram
+	batchBytes   histogram
 }
 
 // New create a pool of workers
 func New(cfg Config) *Server {
+	return NewWithContext(context.Background(), cfg)
+}
 
+// NewWithContext create a pool of workers tied to the context, when the
+// context is cancelled the pool exits flushing the pending records
+func NewWithContext(ctx context.Context, cfg Config) *Server {
+	srv := newServer(ctx, cfg)
+	go srv._reload()
+	return srv
+}
+
+// newServer creates the pool without the background loop that connects it,
+// the first reload is pending in chReload
+func newServer(ctx context.Context, cfg Config) *Server {
 	if cfg.Buffer == 0 {
 		cfg.Buffer = defaultBufferSize
 	}
 
 	srv := &Server{
 		chDone:   make(chan bool, 1),
+		chExited: make(chan struct{}),
 		chReload: make(chan bool, 1),
+		space:    make(chan struct{}, 1),
 		C:        make(chan interface{}, cfg.Buffer),
 	}
+	srv.ctx, srv.cancel = context.WithCancel(ctx)
 
-	go srv._reload()
+	var entries []spoolEntry
+	if cfg.SpoolDir != "" {
+		var err error
+		if srv.spool, entries, err = openSpool(cfg.SpoolDir); err != nil {
+			srv.spool = nil
+			logger := cfg.Logger
+			if logger == nil {
+				logger = defaultLogger
+			}
+			logger.Printf("Firehose ERROR: spool %s disabled: %s", cfg.SpoolDir, err)
+		}
+	}
+
+	go func() {
+		<-srv.ctx.Done()
+		srv.Exit()
+	}()
 
 	srv.Reload(&cfg)
 
+	if srv.spool != nil {
+		for _, path := range srv.spool.corrupted {
+			srv.logf(LogError, "Firehose ERROR: spool segment %s corrupted, the records after the invalid one are lost", path)
+		}
+	}
+	if len(entries) > 0 {
+		srv.logf(LogInfo, "Firehose: sending %d records of the spool %s", len(entries), cfg.SpoolDir)
+		go srv.replaySpool(entries)
+	}
+
 	return srv
 }
 
-// Reload the configuration
+// replaySpool sends the records found in the spool
+func (srv *Server) replaySpool(entries []spoolEntry) {
+	srv.chLock.RLock()
+	defer srv.chLock.RUnlock()
+
+	for i, e := range entries {
+		if srv.isExiting() {
+			return
+		}
+		record := &callbackRecord{record: e.data, fn: func(seq int64) func(error) {
+			return func(err error) { srv.spool.result(seq, err) }
+		}(e.seq)}
+		if err := srv.enqueue(srv.ctx, int64(len(e.data)), record, false); err != nil {
+			srv.logf(LogError, "Firehose: %d records of the spool not sent: %s", len(entries)-i, err)
+			return
+		}
+	}
+}
+
+// Connect create a pool of workers like NewWithContext but it connects to the
+// stream before returning, if the first connection fails the pool exits and
+// the error is returned. Later failures are retried in the background.
+func Connect(ctx context.Context, cfg Config) (*Server, error) {
+	srv := newServer(ctx, cfg)
+
+	// The first connection is made here instead of in the background loop,
+	// it's only tried once and OnConnect or OnReset are called once
+	select {
+	case <-srv.chReload:
+	default:
+	}
+	if err := srv.reset(); err != nil {
+		srv.Exit()
+		return nil, err
+	}
+
+	go srv._reload()
+	return srv, nil
+}
+
+// share publishes a copy of cfg for the clients and the Send calls, they read
+// it without the lock. It's called with the lock after every change of cfg.
+func (srv *Server) share() {
+	cfg := srv.cfg
+	srv.config.Store(&cfg)
+}
+
+// conf returns the configuration for the readers without the lock, it's
+// never modified once shared
+func (srv *Server) conf() *Config {
+	if cfg := srv.config.Load(); cfg != nil {
+		return cfg
+	}
+	return &srv.cfg
+}
+
+// Reload the configuration, if the stream or the AWS settings changed the
+// connection is created again
 func (srv *Server) Reload(cfg *Config) (err error) {
 	srv.Lock()
 	defer srv.Unlock()
 
+	// A different stream or credentials requires a new connection
+	if !sameConnection(srv.cfg, *cfg) {
+		srv.connected = false
+		srv.recycle = true
+	}
+
 	srv.cfg = *cfg
 
+	if srv.cfg.Logger == nil {
+		srv.cfg.Logger = defaultLogger
+	}
+
+	if srv.cfg.Marshal == nil {
+		srv.cfg.Marshal = json.Marshal
+	}
+
+	if srv.cfg.SplitFunc == nil {
+		srv.cfg.SplitFunc = SplitLines
+	}
+
+	level, ok := logLevels[srv.cfg.LogLevel]
+	if !ok {
+		if srv.cfg.LogLevel != "" {
+			srv.cfg.Logger.Printf("Firehose ERROR: unknown log level %s, using info", srv.cfg.LogLevel)
+		}
+		srv.cfg.LogLevel, level = LogInfo, logLevels[LogInfo]
+	}
+	srv.logLevel.Store(level)
+
+	if srv.cfg.MinWorkers <= 0 {
+		srv.cfg.MinWorkers = defaultWorkers
+	}
+
 	if srv.cfg.MaxWorkers == 0 {
 		srv.cfg.MaxWorkers = defaultMaxWorkers
 	}
@@ -104,13 +524,109 @@ func (srv *Server) Reload(cfg *Config) (err error) {
 		srv.cfg.CoolDownPeriod = defaultCoolDownPeriod
 	}
 
+	if srv.cfg.MaxRetries == 0 {
+		srv.cfg.MaxRetries = maxRecordRetries
+	}
+
 	if srv.cfg.MaxRecords == 0 {
 		srv.cfg.MaxRecords = defaultMaxRecords
 	}
 
+	if srv.cfg.MaxRecordSize <= 0 || srv.cfg.MaxRecordSize > maxRecordSize {
+		srv.cfg.MaxRecordSize = maxRecordSize
+	}
+
+	if srv.cfg.FlushSize <= 0 || srv.cfg.FlushSize > maxBatchSize {
+		srv.cfg.FlushSize = defaultFlushSize
+	}
+
+	switch srv.cfg.Compression {
+	case "":
+		srv.cfg.Compression = CompressionNone
+	case CompressionNone:
+	default:
+		if compressor(srv.cfg.Compression) == nil {
+			srv.logf(LogError, "Firehose ERROR: unknown compression %s, records will be sent uncompressed", srv.cfg.Compression)
+			srv.cfg.Compression = CompressionNone
+		}
+	}
+
+	switch srv.cfg.Target {
+	case "":
+		srv.cfg.Target = TargetFirehose
+	case TargetFirehose, TargetKinesis:
+	default:
+		srv.logf(LogError, "Firehose ERROR: unknown target %s, records will be sent to Firehose", srv.cfg.Target)
+		srv.cfg.Target = TargetFirehose
+	}
+
+	// The consumers of Kinesis read the records one by one, no newline
+	if srv.cfg.Target == TargetKinesis && srv.cfg.Framing == "" && !srv.cfg.Aggregate {
+		srv.cfg.Framing = FramingNone
+	}
+
+	switch srv.cfg.Framing {
+	case "", FramingNewline, FramingLengthPrefixed, FramingNone:
+	default:
+		srv.logf(LogError, "Firehose ERROR: unknown framing %s, records will be newline terminated", srv.cfg.Framing)
+		srv.cfg.Framing = FramingNewline
+	}
+
+	switch srv.cfg.OverflowPolicy {
+	case "":
+		srv.cfg.OverflowPolicy = OverflowBlock
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+	default:
+		srv.logf(LogError, "Firehose ERROR: unknown overflow policy %s, Send will block", srv.cfg.OverflowPolicy)
+		srv.cfg.OverflowPolicy = OverflowBlock
+	}
+
+	if srv.cfg.FlushInterval.Nanoseconds() <= 0 {
+		srv.cfg.FlushInterval = defaultFlushInterval
+	}
+
+	if srv.cfg.FlushTimeout.Nanoseconds() <= 0 {
+		srv.cfg.FlushTimeout = defaultFlushTimeout
+	}
+
+	if srv.cfg.ConnectionRetry.Nanoseconds() <= 0 {
+		srv.cfg.ConnectionRetry = connectionRetry
+	}
+
+	if srv.cfg.MaxConnectionRetry.Nanoseconds() <= 0 {
+		srv.cfg.MaxConnectionRetry = maxConnectionRetry
+	}
+
+	if srv.cfg.MaxConnectionRetry < srv.cfg.ConnectionRetry {
+		srv.cfg.MaxConnectionRetry = srv.cfg.ConnectionRetry
+	}
+
+	if srv.cfg.ConnectTimeout.Nanoseconds() <= 0 {
+		srv.cfg.ConnectTimeout = connectTimeout
+	}
+
+	if srv.cfg.BatchTimeout.Nanoseconds() <= 0 {
+		srv.cfg.BatchTimeout = srv.cfg.ConnectTimeout
+	}
+
+	if srv.cfg.ErrorsFrame.Nanoseconds() <= 0 {
+		srv.cfg.ErrorsFrame = errorsFrame
+	}
+
+	if srv.cfg.MaxErrors <= 0 {
+		srv.cfg.MaxErrors = maxErrors
+	}
+
+	srv.batchLimit.setRate(srv.cfg.MaxBatchesPerSecond)
+	srv.recordLimit.setRate(srv.cfg.MaxRecordsPerSecond)
+
+	if srv.cfg.MaxBatchErrors <= 0 {
+		srv.cfg.MaxBatchErrors = maxErrors
+	}
+
 	if srv.cfg.MaxWorkers > srv.cfg.MinWorkers {
 		monadCfg := &monad.Config{
-			Min:            uint64(1),
+			Min:            uint64(srv.cfg.MinWorkers),
 			Max:            uint64(srv.cfg.MaxWorkers),
 			Interval:       srv.cfg.Interval,
 			CoolDownPeriod: srv.cfg.CoolDownPeriod,
@@ -119,14 +635,19 @@ func (srv *Server) Reload(cfg *Config) (err error) {
 					return true
 				}
 
-				l := float64(len(srv.C))
+				// The buffer fills while paused, more clients won't help
+				if srv.Paused() {
+					return false
+				}
+
+				l := float64(srv.QueueLen())
 				if l == 0 {
 					return false
 				}
 
-				currPtc := (l / float64(cap(srv.C))) * 100
+				currPtc := (l / float64(srv.QueueCap())) * 100
 
-				if currPtc > srv.cfg.ThresholdWarmUp*100 {
+				if currPtc > srv.conf().ThresholdWarmUp*100 {
 					return true
 				}
 				return false
@@ -146,13 +667,17 @@ func (srv *Server) Reload(cfg *Config) (err error) {
 			go srv.monad.Reload(monadCfg)
 		}
 	} else {
+		// The clients are created by clientsReset once it's connected, a
+		// negative MaxWorkers or one under MinWorkers doesn't leave the
+		// pool without clients
 		srv.cliDesired = srv.cfg.MaxWorkers
-		for len(srv.clients) < srv.cliDesired {
-			srv.clients = append(srv.clients, NewClient(srv))
+		if srv.cliDesired < srv.cfg.MinWorkers {
+			srv.cliDesired = srv.cfg.MinWorkers
 		}
 	}
 
-	log.Printf("Firehose config: %#v", srv.cfg)
+	srv.share()
+	srv.logf(LogDebug, "Firehose config: %#v", srv.cfg)
 
 	select {
 	case srv.chReload <- true:
@@ -162,68 +687,734 @@ func (srv *Server) Reload(cfg *Config) (err error) {
 	return nil
 }
 
-// Flush terminate all clients and close the channels
-func (srv *Server) Flush() (err error) {
+// Send puts the record in the buffer of the pool like SendWithContext
+// without a deadline. A nil error means the record was accepted in the
+// buffer, not that it was delivered, SendWithCallback reports that.
+func (srv *Server) Send(record []byte) error {
+	return srv.SendWithContext(context.Background(), record)
+}
+
+// SendValue marshals v with Marshal before sending it like Send, the cost of
+// the serialization is paid by the caller instead of the clients. The errors
+// of Marshal are returned.
+func (srv *Server) SendValue(v interface{}) error {
+	b, err := srv.conf().Marshal(v)
+	if err != nil {
+		return err
+	}
+	return srv.Send(b)
+}
+
+// TrySend puts the record in the buffer without waiting, it returns false
+// when there is no room for it or it's rejected for any other reason, like
+// Send would return an error. The OverflowPolicy is not applied, the caller
+// decides what to do with the record. Every false counts in RecordsDropped.
+func (srv *Server) TrySend(record []byte) bool {
+	if err := srv.send(context.Background(), record, record, true); err != nil {
+		atomic.AddInt64(&srv.stats.RecordsDropped, 1)
+		return false
+	}
+	return true
+}
+
+// Replay puts back in the buffer records that were discarded, the Data of
+// FailedRecord as it was reported to ErrChan or OnDrop. They are already
+// compressed and framed, also the ones dropped before reaching a client, so
+// they are sent as they are, and they are retried up to MaxRetries times like
+// the failed records of a batch. It blocks while the buffer is full, records
+// larger than MaxRecordSize are skipped and the first error is returned. The
+// slices must not be modified after the call.
+func (srv *Server) Replay(records [][]byte) error {
+	srv.chLock.RLock()
+	defer srv.chLock.RUnlock()
+
+	var first error
+	for i, b := range records {
+		if srv.isExiting() {
+			return ErrExiting
+		}
+		if srv.conf().FailFast && srv.failing.Load() {
+			atomic.AddInt64(&srv.stats.RecordsRejected, int64(len(records)-i))
+			return ErrPoolFailing
+		}
+		if len(b) > srv.conf().MaxRecordSize {
+			atomic.AddInt64(&srv.stats.RecordsRejected, 1)
+			if first == nil {
+				first = ErrRecordTooLarge
+			}
+			continue
+		}
+		if err := srv.enqueue(srv.ctx, int64(len(b)), &retryRecord{b: b, bytes: int64(len(b))}, false); err != nil {
+			return err
+		}
+	}
+	return first
+}
+
+// SendWithContext puts the record in the buffer of the pool, if the buffer
+// is full it blocks until there is room for the record or the context is done.
+// Records that are larger than MaxRecordSize are split with SplitFunc, the ones
+// that can't be split are rejected with ErrRecordTooLarge, if they are
+// compressed with snappy the size is checked later by the client.
+// The error is nil once the record is in the buffer, errors after that are
+// reported to SendWithCallback, OnDrop and ErrChan.
+func (srv *Server) SendWithContext(ctx context.Context, record interface{}) error {
+	return srv.send(ctx, record, record, false)
+}
+
+// SendWithCallback works like SendWithContext but fn is called with the
+// final result once the record was accepted by Firehose or discarded, also
+// after being retried. It is only called when the record was put in the
+// buffer, that is when the returned error is nil. fn runs in the client
+// goroutine so it must not block.
+func (srv *Server) SendWithCallback(ctx context.Context, record interface{}, fn func(err error)) error {
+	if fn == nil {
+		return srv.SendWithContext(ctx, record)
+	}
+	return srv.send(ctx, record, &callbackRecord{record: record, fn: fn}, false)
+}
+
+// SendNow sends the record to Firehose with one PutRecord call, without
+// waiting in the buffer, and returns once it was accepted or failed. The
+// record is compressed and newline terminated like the buffered ones but
+// it's not retried, a connection error counts in the errors of the pool.
+func (srv *Server) SendNow(ctx context.Context, record []byte) error {
+	if srv.isExiting() {
+		return ErrExiting
+	}
+
+	data, err := srv.encode(record)
+	if err != nil {
+		return err
+	}
+
 	srv.Lock()
-	defer srv.Unlock()
+	api, stream := srv.awsSvc, srv.cfg.StreamName
+	srv.Unlock()
+
+	if srv.Paused() {
+		return ErrPaused
+	}
+
+	if err := srv.limit(ctx, 1); err != nil {
+		return err
+	}
+
+	if srv.conf().DryRun {
+		srv.logf(LogDebug, "Firehose DRY RUN: PutRecord of %d bytes", len(data))
+	} else {
+		if api == nil {
+			return ErrNotConnected
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, srv.conf().ConnectTimeout)
+		defer cancel()
+
+		start := time.Now()
+		_, err := api.PutRecord(ctx, &firehose.PutRecordInput{
+			DeliveryStreamName: aws.String(stream),
+			Record:             &types.Record{Data: data},
+		}, srv.conf().RequestOptions...)
+		srv.latency.observe(latencyBounds, int64(time.Since(start)))
+		if err != nil {
+			err = classifyError(err)
+			if srv.conf().OnFHError != nil {
+				srv.conf().OnFHError(err)
+			}
+			srv.logf(LogError, "Firehose ERROR PutRecord: %s", err)
+			if isConnectionError(err) {
+				srv.failure(err)
+			}
+			return err
+		}
+	}
+
+	atomic.AddInt64(&srv.stats.RecordsSent, 1)
+	atomic.AddInt64(&srv.stats.BytesSent, int64(len(data)))
+	srv.delivered()
+	return nil
+}
+
+// encode compresses and frames a record sent without the buffer, like the
+// clients do
+func (srv *Server) encode(record []byte) ([]byte, error) {
+	data := record
+	if srv.conf().Compress {
+		data = compress.Bytes(record)
+	}
+	data = srv.frame(make([]byte, 0, aggregateHeader+len(data)), data)
+	if len(data) > srv.conf().MaxRecordSize {
+		return nil, ErrRecordTooLarge
+	}
+	return data, nil
+}
+
+// send validates the record and puts the item in the channel, with nowait
+// it doesn't wait for room nor applies the OverflowPolicy and the rejected
+// records are counted by the caller
+func (srv *Server) send(ctx context.Context, record interface{}, item interface{}, nowait bool) error {
+	srv.chLock.RLock()
+	defer srv.chLock.RUnlock()
+
+	if srv.isExiting() {
+		return ErrExiting
+	}
+
+	if srv.conf().FailFast && srv.failing.Load() {
+		srv.rejected(nowait)
+		return ErrPoolFailing
+	}
+
+	// The hook gets the context of every record
+	if srv.conf().BatchHook != nil {
+		if cr, ok := item.(*callbackRecord); ok {
+			item = &callbackRecord{record: cr.record, fn: cr.fn, ctx: ctx}
+		} else {
+			item = &callbackRecord{record: record, ctx: ctx}
+		}
+	}
+
+	b, ok := record.([]byte)
+	if ok && !srv.conf().Compress && srv.framedLen(b) > srv.conf().MaxRecordSize {
+		if srv.conf().SplitFunc == nil {
+			return ErrRecordTooLarge
+		}
+		return srv.sendSplit(ctx, b, item, nowait)
+	}
+
+	return srv.put(ctx, record, item, nowait)
+}
+
+// rejected counts a record that couldn't be put in the buffer, unless it's
+// counted by the caller
+func (srv *Server) rejected(nowait bool) {
+	if !nowait {
+		atomic.AddInt64(&srv.stats.RecordsRejected, 1)
+	}
+}
+
+// put puts the item in the channel, the []byte records are spooled first
+func (srv *Server) put(ctx context.Context, record interface{}, item interface{}, nowait bool) error {
+	b, ok := record.([]byte)
+
+	// Other types are accounted once they are serialized by the client
+	size := int64(len(b))
+
+	if ok && srv.spool != nil {
+		seq, err := srv.spool.append(b)
+		if err != nil {
+			return err
+		}
+		if err := srv.enqueue(ctx, size, srv.spool.spooled(item, record, seq), nowait); err != nil {
+			srv.spool.done(seq)
+			return err
+		}
+		return nil
+	}
+
+	return srv.enqueue(ctx, size, item, nowait)
+}
+
+// enqueue puts the item in the channel once the bytes are reserved, with
+// nowait it returns ErrBufferFull instead of waiting or applying the policy
+func (srv *Server) enqueue(ctx context.Context, size int64, item interface{}, nowait bool) error {
+	if err := srv.reserve(ctx, size, nowait); err == errDropNewest {
+		srv.evict(item, ErrBufferFull)
+		return nil
+	} else if err != nil {
+		srv.rejected(nowait)
+		return err
+	}
+
+	// Records go to the buffer of a worker, the shared one is used only when
+	// all of them are full or there are no clients yet
+	workers, _ := srv.workers.Load().([]*Client)
+	n := srv.shard(item)
+	if offer(workers, n, item) {
+		return nil
+	}
+
+	if nowait {
+		select {
+		case srv.C <- item:
+			return nil
+		default:
+			srv.release(size)
+			return ErrBufferFull
+		}
+	}
 
-	if srv.exiting {
+	switch srv.conf().OverflowPolicy {
+	case OverflowDropNewest:
+		select {
+		case srv.C <- item:
+		default:
+			srv.evict(item, ErrBufferFull)
+		}
 		return nil
+	case OverflowDropOldest:
+		// The item takes the place of the evicted one, without buffers
+		// there is nothing to evict and it waits as usual
+		for {
+			select {
+			case srv.C <- item:
+				return nil
+			default:
+			}
+			if !srv.evictOldest(workers, n) {
+				break
+			}
+			if offer(workers, n, item) {
+				return nil
+			}
+		}
+	}
+
+	// Without waiting first, a done context would be picked at random
+	select {
+	case srv.C <- item:
+		return nil
+	default:
+	}
+
+	select {
+	case srv.C <- item:
+		return nil
+	case <-ctx.Done():
+		srv.release(size)
+		srv.rejected(nowait)
+		return ctx.Err()
+	case <-srv.ctx.Done():
+		srv.release(size)
+		srv.rejected(nowait)
+		return ErrExiting
+	}
+}
+
+// offer puts the item in the buffer of the first worker from n with room
+func offer(workers []*Client, n uint64, item interface{}) bool {
+	for i := range workers {
+		if workers[(n+uint64(i))%uint64(len(workers))].offer(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// evictOldest discards the oldest record of the buffers for OverflowDropOldest,
+// the one at the head of the buffer of the first worker from n with records or
+// of the shared one. The records of the workers were buffered first, the
+// shared buffer only has records when they are full.
+func (srv *Server) evictOldest(workers []*Client, n uint64) bool {
+	for i := range workers {
+		select {
+		case old := <-workers[(n+uint64(i))%uint64(len(workers))].C:
+			srv.evict(old, ErrBufferFull)
+			return true
+		default:
+		}
+	}
+	select {
+	case old := <-srv.C:
+		srv.evict(old, ErrBufferFull)
+		return true
+	default:
+	}
+	return false
+}
+
+// requeue puts back an item that was already in a buffer, its bytes are
+// still reserved. It goes to the shared buffer if the workers are full. It
+// doesn't block, it returns false if all the buffers are full. Once the pool
+// is exiting the item is discarded.
+func (srv *Server) requeue(item interface{}) bool {
+	workers, _ := srv.workers.Load().([]*Client)
+	if offer(workers, srv.shard(item), item) {
+		return true
+	}
+
+	// Avoid sending to C while it's being closed
+	srv.chLock.RLock()
+	defer srv.chLock.RUnlock()
+
+	// Once the pool is exiting C could be already closed
+	if srv.ctx.Err() != nil {
+		srv.evict(item, ErrExiting)
+		return true
+	}
+	select {
+	case srv.C <- item:
+		return true
+	default:
+		return false
+	}
+}
+
+// shard returns the first worker to try for the item, by ShardKey or
+// round-robin for the records without a key
+func (srv *Server) shard(item interface{}) uint64 {
+	if srv.conf().ShardKey != nil {
+		record := item
+		if cr, ok := item.(*callbackRecord); ok {
+			record = cr.record
+		}
+		if b, ok := record.([]byte); ok {
+			return uint64(srv.conf().ShardKey(b))
+		}
+	}
+	return atomic.AddUint64(&srv.next, 1)
+}
+
+// errDropNewest is returned by reserve when the new record must be dropped
+var errDropNewest = errors.New("drop the newest record")
+
+// reserve accounts the bytes of a new record, if MaxBufferedBytes is reached
+// it waits until other records are sent or returns ErrBufferFull. A record
+// larger than the limit is accepted when nothing else is buffered. With
+// nowait it doesn't wait nor apply the overflow policy.
+func (srv *Server) reserve(ctx context.Context, n int64, nowait bool) error {
+	cfg := srv.conf()
+	for {
+		b := atomic.AddInt64(&srv.buffered, n)
+		if cfg.MaxBufferedBytes <= 0 || b <= int64(cfg.MaxBufferedBytes) || b == n {
+			if cfg.MaxBufferedBytes > 0 && b < int64(cfg.MaxBufferedBytes) {
+				srv.signalSpace() // Wake up the next waiting sender
+			}
+			return nil
+		}
+		if nowait {
+			atomic.AddInt64(&srv.buffered, -n)
+			return ErrBufferFull
+		}
+		if cfg.OverflowPolicy == OverflowDropNewest && !cfg.BufferFullError {
+			// The bytes stay reserved, they are released with the record
+			return errDropNewest
+		}
+		atomic.AddInt64(&srv.buffered, -n)
+
+		if cfg.BufferFullError {
+			return ErrBufferFull
+		}
+
+		switch cfg.OverflowPolicy {
+		case OverflowDropOldest:
+			// The bytes of the evicted record are released, if the buffers
+			// are empty they are in the batches of the clients
+			workers, _ := srv.workers.Load().([]*Client)
+			if srv.evictOldest(workers, 0) {
+				continue
+			}
+		}
+
+		select {
+		case <-srv.space:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-srv.ctx.Done():
+			return ErrExiting
+		}
+	}
+}
+
+// release the bytes of records that were sent or discarded
+func (srv *Server) release(n int64) {
+	if n == 0 {
+		return
+	}
+	atomic.AddInt64(&srv.buffered, -n)
+	srv.signalSpace()
+}
+
+func (srv *Server) signalSpace() {
+	select {
+	case srv.space <- struct{}{}:
+	default:
 	}
+}
 
-	for _, c := range srv.clients {
-		c.finish <- false // It will flush
+// Flush sends the records in the buffer and the partial batches of all the
+// clients, it blocks until the PutRecordBatch calls finished or the context
+// is done. The pool keeps running, records that failed are retried as usual
+// and the first error is returned.
+func (srv *Server) Flush(ctx context.Context) error {
+	srv.Lock()
+	if srv.exiting.Load() {
+		srv.Unlock()
+		return ErrExiting
 	}
+	if srv.resumed() != nil {
+		srv.Unlock()
+		return ErrPaused
+	}
+	clients := make([]*Client, len(srv.clients))
+	copy(clients, srv.clients)
+	srv.Unlock()
 
-	for _, c := range srv.clients {
-		f := <-c.flushed
-		if !f {
-			return errors.New("Flushed failed")
+	// Records still in the channel are taken by the clients first
+	t := time.NewTicker(flushPollInterval)
+	defer t.Stop()
+	for len(srv.C) > 0 {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 
-	return
+	results := make([]chan error, len(clients))
+	for i, c := range clients {
+		results[i] = make(chan error, 1)
+		select {
+		case c.flushC <- results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var err error
+	for _, ch := range results {
+		select {
+		case e := <-ch:
+			if err == nil {
+				err = e
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
+
+// SwitchStream sends the records to a new stream: it flushes the pending
+// records to the current one, connects to the new one and replaces the
+// clients. If the new stream can't be used the pool goes back to the
+// current one and the error is returned.
+func (srv *Server) SwitchStream(ctx context.Context, name string) error {
+	if err := srv.Flush(ctx); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// StreamName is read with the lock or from the shared copy, the clients and the calls
+	// without the buffer keep a copy of the stream they send to
+	srv.Lock()
+	old := srv.cfg.StreamName
+	srv.cfg.StreamName = name
+	srv.share()
+	srv.connected = false
+	srv.recycle = true
+	srv.Unlock()
+
+	err := srv.reset()
+	if err == nil {
+		srv.logf(LogInfo, "Firehose: switched from the stream %s to %s", old, name)
+		return nil
+	}
+
+	srv.logf(LogError, "Firehose ERROR: switching to the stream %s: %s", name, err)
+	srv.Lock()
+	srv.cfg.StreamName = old
+	srv.share()
+	srv.connected = false
+	srv.recycle = true
+	srv.Unlock()
+	select {
+	case srv.chReload <- true:
+	default:
+	}
+	return err
 }
 
 // Exit terminate all clients and close the channels
 func (srv *Server) Exit() {
 	srv.Lock()
-	if srv.exiting {
+	if !srv.exiting.CompareAndSwap(false, true) {
 		srv.Unlock()
 		return
 	}
-	srv.exiting = true
+	srv.setWorkers(nil)
+	if srv.ageTimer != nil {
+		srv.ageTimer.Stop()
+	}
+	clients := srv.clients
 	srv.Unlock()
 
+	// Release the context watcher and any pending reconnection wait
+	srv.cancel()
+
 	if srv.monad != nil {
 		srv.monad.Exit()
 	}
 
 	close(srv.chReload)
 
-	for _, c := range srv.clients {
-		c.Exit()
+	// Clients flush in parallel so the exit is bounded by FlushTimeout
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			c.Exit()
+		}(c)
 	}
+	wg.Wait()
 
-	if len(srv.C) > 0 {
-		log.Printf("Firehose: messages lost %d", len(srv.C))
+	if n := srv.lose(clients); n > 0 {
+		srv.logf(LogError, "Firehose: messages lost %d", n)
 	}
 
+	srv.chLock.Lock()
 	close(srv.C)
+	srv.chLock.Unlock()
+
+	if srv.spool != nil {
+		if err := srv.spool.close(); err != nil {
+			srv.logf(LogError, "Firehose ERROR: closing the spool: %s", err)
+		}
+	}
+
+	// Clients that were stopped before or timed out exit on their own
+	go func() {
+		srv.running.Wait()
+		close(srv.chExited)
+	}()
 
 	// finishing the server
 	srv.chDone <- true
 }
 
-func (srv *Server) isExiting() bool {
+// Status is the state of the connection of the pool to the stream
+type Status struct {
+	Connected      bool
+	Exiting        bool
+	LastConnection time.Time // Last successful connection to the stream
+	LastErrorTime  time.Time
+	LastError      error
+	Errors         int64 // Errors counted in the current ErrorsFrame
+	BatchErrors    int64 // Batches rejected by the stream in the current ErrorsFrame
+}
+
+// Status returns the current state of the connection
+func (srv *Server) Status() Status {
 	srv.Lock()
 	defer srv.Unlock()
 
-	if srv.exiting {
+	return Status{
+		Connected:      srv.connected,
+		Exiting:        srv.exiting.Load(),
+		LastConnection: srv.lastConnection,
+		LastErrorTime:  srv.lastError,
+		LastError:      srv.lastErr,
+		Errors:         srv.errors,
+		BatchErrors:    srv.batchErrors,
+	}
+}
+
+// StreamARN returns the ARN of the stream of the last connection, empty if
+// it never connected or with SkipDescribe
+func (srv *Server) StreamARN() string {
+	srv.Lock()
+	defer srv.Unlock()
+
+	return srv.streamARN
+}
+
+// DeliveryStreamType returns the type of the stream of the last connection,
+// e.g. DirectPut or KinesisStreamAsSource
+func (srv *Server) DeliveryStreamType() types.DeliveryStreamType {
+	srv.Lock()
+	defer srv.Unlock()
+
+	return srv.streamType
+}
+
+// DestinationType returns the destination of the stream of the last
+// connection, one of the Destination constants. It's empty if it never
+// connected, with SkipDescribe or if the destination is not known.
+func (srv *Server) DestinationType() string {
+	srv.Lock()
+	defer srv.Unlock()
+
+	return srv.destination
+}
+
+// Encryption returns the server-side encryption configuration of the stream
+// of the last connection, nil if it's not connected or it's not encrypted
+func (srv *Server) Encryption() *types.DeliveryStreamEncryptionConfiguration {
+	srv.Lock()
+	defer srv.Unlock()
+
+	if srv.encryption == nil {
+		return nil
+	}
+	e := *srv.encryption
+	return &e
+}
+
+// Healthy reports whether the pool is connected to the stream and it's not
+// failing, it can be used as a readiness probe
+func (srv *Server) Healthy() bool {
+	srv.Lock()
+	defer srv.Unlock()
+
+	if srv.exiting.Load() || !srv.connected {
+		return false
+	}
+
+	// Old errors don't count once the frame is over
+	if srv.now().Sub(srv.lastError) > srv.cfg.ErrorsFrame {
 		return true
 	}
 
-	return false
+	return srv.errors <= int64(srv.cfg.MaxErrors)
+}
+
+// QueueLen returns the records in the buffers waiting for a client
+func (srv *Server) QueueLen() int {
+	l := len(srv.C)
+	workers, _ := srv.workers.Load().([]*Client)
+	for _, c := range workers {
+		l += len(c.C)
+	}
+	return l
+}
+
+// QueueCap returns the size of the buffers, the shared one and the one of
+// every worker
+func (srv *Server) QueueCap() int {
+	l := cap(srv.C)
+	workers, _ := srv.workers.Load().([]*Client)
+	for _, c := range workers {
+		l += cap(c.C)
+	}
+	return l
+}
+
+// Close terminates the pool like Exit and waits until all the clients
+// finished, it's safe to call it several times and from several goroutines
+func (srv *Server) Close() error {
+	srv.closeOnce.Do(srv.Exit)
+	<-srv.Done()
+	return nil
+}
+
+func (srv *Server) isExiting() bool {
+	return srv.exiting.Load()
+}
+
+// setWorkers publishes the clients that Send dispatches to, it must be
+// called with the lock held every time srv.clients changes
+func (srv *Server) setWorkers(clients []*Client) {
+	srv.workers.Store(append([]*Client(nil), clients...))
+}
+
+// Done returns a channel that is closed once the pool exited and all the
+// client goroutines returned, after their final flush
+func (srv *Server) Done() <-chan struct{} {
+	return srv.chExited
 }
 
 // Waiting to the server if is running
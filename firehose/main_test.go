@@ -0,0 +1,493 @@
+package firehosePool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func newTestServer(buffer int) *Server {
+	srv := &Server{
+		cfg:      Config{Logger: defaultLogger, MaxRecordSize: maxRecordSize},
+		C:        make(chan interface{}, buffer),
+		space:    make(chan struct{}, 1),
+		chReload: make(chan bool, 1),
+		chDone:   make(chan bool, 1),
+		chExited: make(chan struct{}),
+	}
+	srv.ctx, srv.cancel = context.WithCancel(context.Background())
+	return srv
+}
+
+func TestSendWithContext(t *testing.T) {
+	srv := newTestServer(1)
+
+	if err := srv.SendWithContext(context.Background(), []byte("first")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if srv.QueueLen() != 1 || srv.QueueCap() != 1 {
+		t.Errorf("expected a full queue, got %d/%d", srv.QueueLen(), srv.QueueCap())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := srv.SendWithContext(ctx, []byte("second")); err != context.DeadlineExceeded {
+		t.Errorf("expected %s with a full buffer, got %v", context.DeadlineExceeded, err)
+	}
+	if n := srv.Stats().RecordsRejected; n != 1 {
+		t.Errorf("expected 1 record rejected, got %d", n)
+	}
+
+	srv.exiting.Store(true)
+	if err := srv.SendWithContext(context.Background(), []byte("third")); err != ErrExiting {
+		t.Errorf("expected %s, got %v", ErrExiting, err)
+	}
+}
+
+func TestSend(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.MaxRecordSize = 10
+	srv.cfg.MaxBufferedBytes = 8
+	srv.cfg.BufferFullError = true
+
+	if err := srv.Send([]byte("record")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := srv.Send(make([]byte, 10)); err != ErrRecordTooLarge {
+		t.Errorf("expected %s, got %v", ErrRecordTooLarge, err)
+	}
+	if err := srv.Send([]byte("full")); err != ErrBufferFull {
+		t.Errorf("expected %s, got %v", ErrBufferFull, err)
+	}
+
+	srv.exiting.Store(true)
+	if err := srv.Send([]byte("exit")); err != ErrExiting {
+		t.Errorf("expected %s, got %v", ErrExiting, err)
+	}
+	if len(srv.C) != 1 {
+		t.Errorf("expected only the first record in the buffer, got %d", len(srv.C))
+	}
+}
+
+func TestSendValue(t *testing.T) {
+	srv := newTestServer(2)
+	srv.Reload(&Config{StreamName: "test", MinWorkers: 1, MaxWorkers: 1})
+
+	if err := srv.SendValue(map[string]int{"a": 1}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if b := (<-srv.C).([]byte); string(b) != `{"a":1}` {
+		t.Errorf("expected the JSON of the value, got %s", b)
+	}
+
+	if err := srv.SendValue(func() {}); err == nil {
+		t.Errorf("expected the error of json.Marshal")
+	}
+
+	failed := errors.New("marshal failed")
+	srv.cfg.Marshal = func(interface{}) ([]byte, error) { return nil, failed }
+	srv.share()
+	if err := srv.SendValue("value"); err != failed {
+		t.Errorf("expected %s, got %v", failed, err)
+	}
+	if len(srv.C) != 0 {
+		t.Errorf("expected nothing in the buffer, got %d", len(srv.C))
+	}
+}
+
+func TestTrySend(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.OverflowPolicy = OverflowDropNewest
+
+	if !srv.TrySend([]byte("first")) {
+		t.Fatalf("expected the first record in the buffer")
+	}
+	for i := 0; i < 100; i++ {
+		if srv.TrySend([]byte("second")) {
+			t.Fatalf("expected the record rejected with a full buffer")
+		}
+	}
+	if s := srv.Stats(); s.RecordsDropped != 100 || s.RecordsRejected != 0 {
+		t.Errorf("expected 100 dropped and none rejected, got %d and %d", s.RecordsDropped, s.RecordsRejected)
+	}
+
+	<-srv.C
+	srv.release(5)
+	srv.cfg.MaxBufferedBytes = 8
+	if !srv.TrySend([]byte("third")) || srv.TrySend([]byte("fourth")) {
+		t.Errorf("expected only the third record within MaxBufferedBytes")
+	}
+	if srv.buffered != 5 {
+		t.Errorf("expected 5 bytes buffered, got %d", srv.buffered)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	srv := newTestServer(2)
+	srv.cfg.MaxRecordSize = 8
+
+	err := srv.Replay([][]byte{[]byte("first\n"), make([]byte, 9), []byte("second\n")})
+	if err != ErrRecordTooLarge {
+		t.Errorf("expected %s, got %v", ErrRecordTooLarge, err)
+	}
+	if len(srv.C) != 2 {
+		t.Fatalf("expected 2 records in the buffer, got %d", len(srv.C))
+	}
+	for _, expected := range []string{"first\n", "second\n"} {
+		rr, ok := (<-srv.C).(*retryRecord)
+		if !ok || string(rr.b) != expected || rr.attempts != 0 || rr.bytes != int64(len(expected)) {
+			t.Errorf("expected a retry record %q, got %+v", expected, rr)
+		}
+	}
+	if s := srv.Stats(); s.RecordsRejected != 1 {
+		t.Errorf("expected 1 rejected record, got %d", s.RecordsRejected)
+	}
+
+	srv.exiting.Store(true)
+	if err := srv.Replay([][]byte{[]byte("exit\n")}); err != ErrExiting {
+		t.Errorf("expected %s, got %v", ErrExiting, err)
+	}
+}
+
+func TestReplayEvicted(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.OverflowPolicy = OverflowDropOldest
+	errs := make(chan FailedRecord, 1)
+	srv.cfg.ErrChan = errs
+
+	for _, r := range []string{"evicted", "kept"} {
+		if err := srv.Send([]byte(r)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	<-srv.C
+	failed := <-errs
+	if failed.Err != ErrBufferFull {
+		t.Fatalf("expected the record evicted with %s, got %v", ErrBufferFull, failed.Err)
+	}
+
+	// The evicted record is replayed as it would have been sent
+	if err := srv.Replay([][]byte{failed.Data}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var sent []string
+	fake := &fakeAPI{put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+		for _, r := range in.Records {
+			sent = append(sent, string(r.Data))
+		}
+		return &firehose.PutRecordBatchOutput{
+			FailedPutCount:   aws.Int32(0),
+			RequestResponses: make([]types.PutRecordBatchResponseEntry, len(in.Records)),
+		}, nil
+	}}
+	srv.cfg.MaxRecords, srv.cfg.FlushSize = defaultMaxRecords, defaultFlushSize
+	clt := &Client{srv: srv, api: fake, buff: pool.Get(), t: time.NewTimer(time.Minute)}
+	clt.process(<-srv.C)
+	if err := clt.flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(sent) != 1 || sent[0] != "evicted\n" {
+		t.Errorf("expected the evicted record sent once framed, got %q", sent)
+	}
+}
+
+func TestSendWorkers(t *testing.T) {
+	srv := newTestServer(1)
+	a := &Client{C: make(chan interface{}, 1)}
+	b := &Client{C: make(chan interface{}, 1)}
+	stopped := &Client{C: make(chan interface{}, 1), stopped: true}
+	srv.setWorkers([]*Client{a, stopped, b})
+
+	for i := 0; i < 3; i++ {
+		if err := srv.SendWithContext(context.Background(), []byte("record")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// One record for every running worker and the rest in the shared buffer
+	if len(a.C) != 1 || len(b.C) != 1 || len(stopped.C) != 0 || len(srv.C) != 1 {
+		t.Errorf("unexpected dispatch %d/%d/%d, shared %d", len(a.C), len(b.C), len(stopped.C), len(srv.C))
+	}
+	if srv.QueueLen() != 3 || srv.QueueCap() != 4 {
+		t.Errorf("expected a queue of 3/4, got %d/%d", srv.QueueLen(), srv.QueueCap())
+	}
+}
+
+func TestSendShardKey(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.ShardKey = func(b []byte) uint32 { return uint32(b[0] - 'a') }
+	workers := []*Client{{C: make(chan interface{}, 2)}, {C: make(chan interface{}, 2)}, {C: make(chan interface{}, 2)}}
+	srv.setWorkers(workers)
+
+	for _, r := range []string{"a1", "b1", "a2", "d1"} {
+		if err := srv.SendWithContext(context.Background(), []byte(r)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// d is 3, the same client as a, which is full so b takes it
+	for i, want := range [][]string{{"a1", "a2"}, {"b1", "d1"}, nil} {
+		if len(workers[i].C) != len(want) {
+			t.Fatalf("expected %d records in the client %d, got %d", len(want), i, len(workers[i].C))
+		}
+		for _, w := range want {
+			if r := <-workers[i].C; string(r.([]byte)) != w {
+				t.Errorf("expected %s in the client %d, got %s", w, i, r)
+			}
+		}
+	}
+}
+
+func TestSendWithContextRecordTooLarge(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.MaxRecordSize = 10
+
+	if err := srv.SendWithContext(context.Background(), make([]byte, 10)); err != ErrRecordTooLarge {
+		t.Errorf("expected %s, got %v", ErrRecordTooLarge, err)
+	}
+
+	if err := srv.SendWithContext(context.Background(), make([]byte, 9)); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// The newline is not added twice
+	<-srv.C
+	if err := srv.SendWithContext(context.Background(), []byte("123456789\n")); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestSendMaxBufferedBytes(t *testing.T) {
+	srv := newTestServer(10)
+	srv.cfg.MaxBufferedBytes = 10
+	srv.cfg.BufferFullError = true
+
+	if err := srv.SendWithContext(context.Background(), make([]byte, 8)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := srv.SendWithContext(context.Background(), make([]byte, 8)); err != ErrBufferFull {
+		t.Errorf("expected %s, got %v", ErrBufferFull, err)
+	}
+
+	// Blocks until the first record is released
+	srv.cfg.BufferFullError = false
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		srv.release(8)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.SendWithContext(ctx, make([]byte, 8)); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if b := srv.buffered; b != 8 {
+		t.Errorf("expected 8 buffered bytes, got %d", b)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.ErrorsFrame = time.Minute
+	srv.cfg.MaxErrors = 2
+
+	if srv.Healthy() {
+		t.Errorf("not connected pool must not be healthy")
+	}
+
+	srv.connected = true
+	if !srv.Healthy() {
+		t.Errorf("connected pool must be healthy")
+	}
+
+	srv.errors = 3
+	srv.lastError = time.Now()
+	if srv.Healthy() {
+		t.Errorf("pool over the errors limit must not be healthy")
+	}
+
+	srv.lastError = time.Now().Add(-2 * time.Minute)
+	if !srv.Healthy() {
+		t.Errorf("errors out of the frame must not count")
+	}
+
+	srv.lastErr = ErrStreamNotActive
+	if s := srv.Status(); !s.Connected || s.Errors != 3 || s.LastError != ErrStreamNotActive {
+		t.Errorf("unexpected status %+v", s)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.FlushInterval = time.Minute
+
+	// Records not taken by any client can't be flushed
+	srv.C <- []byte("record")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := srv.Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+	<-srv.C
+
+	srv.clients = []*Client{NewClient(srv)}
+	if err := srv.Flush(context.Background()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestExitDone(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.FlushInterval = time.Minute
+	srv.cfg.FlushTimeout = time.Second
+	srv.clients = []*Client{NewClient(srv), NewClient(srv)}
+
+	srv.Exit()
+	select {
+	case <-srv.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Done not closed after Exit")
+	}
+
+	if n := srv.Stats().ActiveClients; n != 0 {
+		t.Errorf("expected no active clients, got %d", n)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.FlushInterval = time.Minute
+	srv.cfg.FlushTimeout = time.Second
+	srv.clients = []*Client{NewClient(srv)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.Close()
+		}()
+	}
+	wg.Wait()
+	srv.Close()
+
+	// A record retried after closing the pool is discarded
+	result := make(chan error, 1)
+	srv.clients[0].retry(batchRecord{buff: pool.Get(), callbacks: []func(error){func(err error) { result <- err }}}, 1)
+	select {
+	case err := <-result:
+		if err != ErrExiting {
+			t.Errorf("expected %s, got %v", ErrExiting, err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the retried record was not discarded")
+	}
+}
+
+func TestSendNow(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.StreamName = "test"
+	srv.cfg.ConnectTimeout = time.Second
+
+	if err := srv.SendNow(context.Background(), []byte("now")); err != ErrNotConnected {
+		t.Errorf("expected %s, got %v", ErrNotConnected, err)
+	}
+
+	var sent []byte
+	fake := &fakeAPI{put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+		sent = in.Records[0].Data
+		return &firehose.PutRecordBatchOutput{RequestResponses: []types.PutRecordBatchResponseEntry{{RecordId: aws.String("1")}}}, nil
+	}}
+	srv.awsSvc = fake
+
+	if err := srv.SendNow(context.Background(), []byte("now")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(sent) != "now\n" || len(srv.C) != 0 {
+		t.Errorf("expected the record sent without buffering, got %q", sent)
+	}
+	if st := srv.Stats(); st.RecordsSent != 1 || st.BytesSent != 4 {
+		t.Errorf("unexpected stats %d records, %d bytes", st.RecordsSent, st.BytesSent)
+	}
+
+	fake.put = func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+		return nil, errors.New("failed")
+	}
+	if err := srv.SendNow(context.Background(), []byte("now")); err == nil {
+		t.Error("expected the error of PutRecord")
+	}
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	for _, c := range []struct {
+		policy   string
+		maxBytes int
+		buffer   int
+		queued   string
+		dropped  string
+	}{
+		{OverflowDropNewest, 0, 1, "a", "b"},
+		{OverflowDropNewest, 1, 2, "a", "b"},
+		{OverflowDropOldest, 0, 1, "b", "a"},
+		{OverflowDropOldest, 1, 2, "b", "a"},
+	} {
+		srv := newTestServer(c.buffer)
+		srv.cfg.OverflowPolicy = c.policy
+		srv.cfg.MaxBufferedBytes = c.maxBytes
+		var dropped []string
+		srv.cfg.OnDrop = func(data []byte) {
+			dropped = append(dropped, string(data))
+		}
+
+		var results []error
+		for _, r := range []string{"a", "b"} {
+			if err := srv.SendWithCallback(context.Background(), []byte(r), func(err error) {
+				results = append(results, err)
+			}); err != nil {
+				t.Fatalf("%s: unexpected error: %s", c.policy, err)
+			}
+		}
+
+		if len(srv.C) != 1 || string((<-srv.C).(*callbackRecord).record.([]byte)) != c.queued {
+			t.Errorf("%s %d: expected %q in the buffer", c.policy, c.maxBytes, c.queued)
+		}
+		// The dropped records are reported framed, ready for Replay
+		if len(dropped) != 1 || dropped[0] != c.dropped+"\n" || len(results) != 1 || results[0] != ErrBufferFull {
+			t.Errorf("%s %d: expected %q dropped with %s, got %q %v", c.policy, c.maxBytes, c.dropped, ErrBufferFull, dropped, results)
+		}
+		if srv.buffered != 1 {
+			t.Errorf("%s %d: expected 1 byte buffered, got %d", c.policy, c.maxBytes, srv.buffered)
+		}
+	}
+
+	// The oldest records are in the buffers of the workers
+	for _, maxBytes := range []int{0, 1} {
+		srv := newTestServer(1)
+		srv.cfg.OverflowPolicy = OverflowDropOldest
+		srv.cfg.MaxBufferedBytes = maxBytes
+		var dropped []string
+		srv.cfg.OnDrop = func(data []byte) {
+			dropped = append(dropped, string(data))
+		}
+		clt := &Client{C: make(chan interface{}, 1)}
+		srv.setWorkers([]*Client{clt})
+
+		for _, r := range []string{"a", "b", "c"} {
+			if err := srv.Send([]byte(r)); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		if len(dropped) == 0 || dropped[0] != "a\n" {
+			t.Errorf("%d: expected the record of the worker dropped first, got %q", maxBytes, dropped)
+		}
+		if r := string((<-clt.C).([]byte)); r != "c" {
+			t.Errorf("%d: expected the newest record in the worker, got %q", maxBytes, r)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Package firehoseOtel traces the PutRecordBatch calls of the firehose pool
+with OpenTelemetry, it's a separated package so OpenTelemetry is only a
+dependency of the programs using it.
+
+	cfg.BatchHook = firehoseOtel.Hook(otel.GetTracerProvider())
+	srv := firehosePool.New(cfg)
+
+Every call is a span linked to the spans of the contexts given to
+SendWithContext or SendWithCallback for the records of the batch.
+*/
+package firehoseOtel
+
+import (
+	"context"
+
+	firehosePool "github.com/gabrielperezs/streamspooler/firehose"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/gabrielperezs/streamspooler/firehose/otel"
+
+// Attributes of the spans
+const (
+	StreamKey  = attribute.Key("firehose.stream")
+	RecordsKey = attribute.Key("firehose.records")
+	BytesKey   = attribute.Key("firehose.bytes")
+	FailedKey  = attribute.Key("firehose.failed")
+)
+
+// Hook returns a BatchHook that starts a span for every PutRecordBatch call
+func Hook(tp trace.TracerProvider) firehosePool.BatchHook {
+	tracer := tp.Tracer(tracerName)
+
+	return func(ctx context.Context, b firehosePool.BatchInfo) (context.Context, func(int, error)) {
+		ctx, span := tracer.Start(ctx, "Firehose.PutRecordBatch",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithLinks(links(b.Contexts)...),
+			trace.WithAttributes(
+				StreamKey.String(b.Stream),
+				RecordsKey.Int(b.Records),
+				BytesKey.Int(b.Bytes),
+			))
+
+		return ctx, func(failed int, err error) {
+			span.SetAttributes(FailedKey.Int(failed))
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			} else if failed > 0 {
+				span.SetStatus(codes.Error, "records rejected")
+			}
+			span.End()
+		}
+	}
+}
+
+// links returns a link to every span of the contexts, once per span
+func links(contexts []context.Context) []trace.Link {
+	var links []trace.Link
+	seen := make(map[trace.SpanID]bool)
+	for _, ctx := range contexts {
+		sc := trace.SpanContextFromContext(ctx)
+		if !sc.IsValid() || seen[sc.SpanID()] {
+			continue
+		}
+		seen[sc.SpanID()] = true
+		links = append(links, trace.Link{SpanContext: sc})
+	}
+	return links
+}
@@ -0,0 +1,48 @@
+package firehoseOtel
+
+import (
+	"context"
+	"testing"
+
+	firehosePool "github.com/gabrielperezs/streamspooler/firehose"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestHook(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+
+	// The span of the producer
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "produce")
+	parent.End()
+
+	hook := Hook(tp)
+	_, end := hook(context.Background(), firehosePool.BatchInfo{
+		Stream:   "test",
+		Records:  2,
+		Bytes:    10,
+		Contexts: []context.Context{ctx, ctx, context.Background()},
+	})
+	end(1, nil)
+
+	spans := rec.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	span := spans[1]
+	if span.Name() != "Firehose.PutRecordBatch" {
+		t.Errorf("unexpected span %q", span.Name())
+	}
+	if l := span.Links(); len(l) != 1 || l[0].SpanContext.SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("expected one link to the producer span, got %v", l)
+	}
+
+	attrs := map[string]int64{}
+	for _, a := range span.Attributes() {
+		attrs[string(a.Key)] = a.Value.AsInt64()
+	}
+	if attrs[string(RecordsKey)] != 2 || attrs[string(BytesKey)] != 10 || attrs[string(FailedKey)] != 1 {
+		t.Errorf("unexpected attributes %v", span.Attributes())
+	}
+}
@@ -0,0 +1,83 @@
+package firehosePool
+
+// Pause stops the clients from sending records to Firehose, the batches in
+// flight finish but new ones are not sent. Send keeps buffering records up to
+// the limits of the buffers and MaxBufferedBytes, then it applies the usual
+// backpressure. Flush and SendNow return ErrPaused, records are still sent on
+// Exit or Close so they are not lost. The clients are not replaced nor
+// removed until Resume, they would send their records when they exit.
+func (srv *Server) Pause() {
+	srv.Lock()
+	defer srv.Unlock()
+
+	if srv.resumed() == nil {
+		srv.logf(LogInfo, "Firehose %s: paused", srv.cfg.StreamName)
+		srv.paused.Store(make(chan struct{}))
+	}
+}
+
+// Resume lets the clients send again the records buffered while paused
+func (srv *Server) Resume() {
+	srv.Lock()
+	defer srv.Unlock()
+
+	if ch := srv.resumed(); ch != nil {
+		srv.logf(LogInfo, "Firehose %s: resumed", srv.cfg.StreamName)
+		srv.paused.Store((chan struct{})(nil))
+		close(ch)
+
+		// The changes of the clients delayed while paused
+		if !srv.exiting.Load() {
+			select {
+			case srv.chReload <- true:
+			default:
+			}
+		}
+	}
+}
+
+// Paused reports whether the pool was paused with Pause
+func (srv *Server) Paused() bool {
+	return srv.resumed() != nil
+}
+
+// resumed returns the channel closed by Resume, nil if it's not paused
+func (srv *Server) resumed() chan struct{} {
+	ch, _ := srv.paused.Load().(chan struct{})
+	return ch
+}
+
+// wait blocks the client while the pool is paused, it returns false if the
+// client was stopped meanwhile
+func (clt *Client) wait(resumed chan struct{}) bool {
+	for {
+		select {
+		case <-resumed:
+			clt.resetTimer()
+			return true
+		case ch := <-clt.flushC:
+			// Resume and a Flush after it could arrive at once
+			if clt.srv.Paused() {
+				ch <- ErrPaused
+				continue
+			}
+			clt.resetTimer()
+			clt.flushRequest(ch)
+			return true
+		case <-clt.finish:
+			return false
+		}
+	}
+}
+
+// hold blocks a flush of the client while the pool is paused, a client that
+// took a record just before Pause doesn't send it. Stopped clients send their
+// records as on Exit.
+func (clt *Client) hold() {
+	if resumed := clt.srv.resumed(); resumed != nil {
+		select {
+		case <-resumed:
+		case <-clt.finish:
+		}
+	}
+}
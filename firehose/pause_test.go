@@ -0,0 +1,151 @@
+package firehosePool
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestPause(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		sent int
+	)
+	fake := &fakeAPI{
+		status: types.DeliveryStreamStatusActive,
+		put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+			mu.Lock()
+			sent += len(in.Records)
+			mu.Unlock()
+			return &firehose.PutRecordBatchOutput{
+				FailedPutCount:   aws.Int32(0),
+				RequestResponses: make([]types.PutRecordBatchResponseEntry, len(in.Records)),
+			}, nil
+		},
+	}
+	cfg := Config{
+		StreamName:       "test",
+		MinWorkers:       1,
+		MaxWorkers:       1,
+		FlushInterval:    10 * time.Millisecond,
+		MaxBufferedBytes: 60,
+		BufferFullError:  true,
+		FirehoseAPI:      fake,
+	}
+	srv := newTestServer(10)
+	srv.Reload(&cfg)
+	defer srv.Exit()
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	srv.Pause()
+	if !srv.Paused() {
+		t.Fatalf("expected the pool paused")
+	}
+
+	// The records are buffered up to the limit
+	for i := 0; i < 10; i++ {
+		if err := srv.Send([]byte("record")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := srv.Send([]byte("record")); err != ErrBufferFull {
+		t.Errorf("expected %s, got %v", ErrBufferFull, err)
+	}
+	if err := srv.Flush(context.Background()); err != ErrPaused {
+		t.Errorf("expected %s, got %v", ErrPaused, err)
+	}
+	if err := srv.SendNow(context.Background(), []byte("now")); err != ErrPaused {
+		t.Errorf("expected %s, got %v", ErrPaused, err)
+	}
+
+	time.Sleep(5 * cfg.FlushInterval)
+	mu.Lock()
+	if sent != 0 {
+		t.Errorf("expected nothing sent while paused, got %d", sent)
+	}
+	mu.Unlock()
+
+	srv.Resume()
+	if err := srv.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if sent != 10 || srv.Paused() {
+		t.Errorf("expected 10 records sent after Resume, got %d", sent)
+	}
+}
+
+func TestPauseBlockedClient(t *testing.T) {
+	sent := make(chan int, 10)
+	fake := &fakeAPI{
+		status: types.DeliveryStreamStatusActive,
+		put: func(in *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+			sent <- len(in.Records)
+			return &firehose.PutRecordBatchOutput{
+				FailedPutCount:   aws.Int32(0),
+				RequestResponses: make([]types.PutRecordBatchResponseEntry, len(in.Records)),
+			}, nil
+		},
+	}
+	cfg := Config{
+		StreamName:    "test",
+		MinWorkers:    2,
+		MaxWorkers:    2,
+		FlushInterval: time.Minute,
+		FlushSize:     1, // Every record sends the previous one
+		FlushTimeout:  time.Second,
+		FirehoseAPI:   fake,
+	}
+	srv := newTestServer(10)
+	srv.Reload(&cfg)
+	defer srv.Exit()
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	clients := srv.clients
+
+	// The clients are waiting for records when it's paused
+	time.Sleep(10 * time.Millisecond)
+	srv.Pause()
+	for i := 0; i < 4; i++ {
+		if err := srv.Send([]byte("record")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// Removing clients would send their records
+	srv.Lock()
+	srv.cliDesired = 1
+	srv.recycle = true
+	srv.Unlock()
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(srv.clients) != 2 || srv.clients[0] != clients[0] || srv.clients[1] != clients[1] {
+		t.Errorf("expected the clients kept while paused")
+	}
+
+	select {
+	case n := <-sent:
+		t.Fatalf("unexpected batch of %d records while paused", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	srv.Resume()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatalf("expected a batch after Resume")
+	}
+	if len(srv.chReload) != 1 {
+		t.Errorf("expected a reload after Resume")
+	}
+}
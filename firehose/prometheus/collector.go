@@ -0,0 +1,118 @@
+/*
+Package firehoseProm provides a Prometheus collector for the firehose pool,
+it's a separated package so the Prometheus client is only a dependency of the
+programs using it.
+
+	srv := firehosePool.New(cfg)
+	prometheus.MustRegister(firehoseProm.New(srv, prometheus.Labels{"stream": cfg.StreamName}))
+*/
+package firehoseProm
+
+import (
+	"time"
+
+	firehosePool "github.com/gabrielperezs/streamspooler/firehose"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "firehose"
+
+// Collector exports the Stats of a firehose Server as Prometheus metrics
+type Collector struct {
+	srv *firehosePool.Server
+
+	recordsSent     *prometheus.Desc
+	bytesSent       *prometheus.Desc
+	recordsFailed   *prometheus.Desc
+	batchesFailed   *prometheus.Desc
+	batchesTimedOut *prometheus.Desc
+	recordsDropped  *prometheus.Desc
+	recordsRejected *prometheus.Desc
+	activeClients   *prometheus.Desc
+	failingEpisodes *prometheus.Desc
+	failingTime     *prometheus.Desc
+	resets          *prometheus.Desc
+	batchLatency    *prometheus.Desc
+	batchRecords    *prometheus.Desc
+	batchBytes      *prometheus.Desc
+}
+
+// New creates a collector of the server metrics, the labels are added to
+// all the metrics to identify the server
+func New(srv *firehosePool.Server, labels prometheus.Labels) *Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, nil, labels)
+	}
+
+	return &Collector{
+		srv:             srv,
+		recordsSent:     desc("records_sent_total", "Records accepted by Firehose."),
+		bytesSent:       desc("bytes_sent_total", "Bytes of the records accepted by Firehose."),
+		recordsFailed:   desc("records_failed_total", "Records rejected by Firehose in a partial failure."),
+		batchesFailed:   desc("batches_failed_total", "PutRecordBatch calls that failed."),
+		batchesTimedOut: desc("batches_timed_out_total", "PutRecordBatch calls that failed because of the timeout."),
+		recordsDropped:  desc("records_dropped_total", "Records discarded without being sent."),
+		recordsRejected: desc("records_rejected_total", "Records that couldn't be added to the buffer."),
+		activeClients:   desc("active_clients", "Clients sending records to Firehose."),
+		failingEpisodes: desc("failing_episodes_total", "Times the pool started failing."),
+		failingTime:     desc("failing_seconds_total", "Time the pool spent failing."),
+		resets:          desc("resets_total", "Times the clients were replaced by the ones of a new connection."),
+		batchLatency:    desc("batch_duration_seconds", "Duration of the PutRecordBatch calls."),
+		batchRecords:    desc("batch_records", "Records of the PutRecordBatch calls."),
+		batchBytes:      desc("batch_bytes", "Bytes of the PutRecordBatch calls."),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.recordsSent
+	ch <- c.bytesSent
+	ch <- c.recordsFailed
+	ch <- c.batchesFailed
+	ch <- c.batchesTimedOut
+	ch <- c.recordsDropped
+	ch <- c.recordsRejected
+	ch <- c.activeClients
+	ch <- c.failingEpisodes
+	ch <- c.failingTime
+	ch <- c.resets
+	ch <- c.batchLatency
+	ch <- c.batchRecords
+	ch <- c.batchBytes
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	st := c.srv.Stats()
+
+	ch <- prometheus.MustNewConstMetric(c.recordsSent, prometheus.CounterValue, float64(st.RecordsSent))
+	ch <- prometheus.MustNewConstMetric(c.bytesSent, prometheus.CounterValue, float64(st.BytesSent))
+	ch <- prometheus.MustNewConstMetric(c.recordsFailed, prometheus.CounterValue, float64(st.RecordsFailed))
+	ch <- prometheus.MustNewConstMetric(c.batchesFailed, prometheus.CounterValue, float64(st.BatchesFailed))
+	ch <- prometheus.MustNewConstMetric(c.batchesTimedOut, prometheus.CounterValue, float64(st.BatchesTimedOut))
+	ch <- prometheus.MustNewConstMetric(c.recordsDropped, prometheus.CounterValue, float64(st.RecordsDropped))
+	ch <- prometheus.MustNewConstMetric(c.recordsRejected, prometheus.CounterValue, float64(st.RecordsRejected))
+	ch <- prometheus.MustNewConstMetric(c.activeClients, prometheus.GaugeValue, float64(st.ActiveClients))
+	ch <- prometheus.MustNewConstMetric(c.failingEpisodes, prometheus.CounterValue, float64(st.FailingEpisodes))
+	ch <- prometheus.MustNewConstMetric(c.failingTime, prometheus.CounterValue, st.FailingTime.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.resets, prometheus.CounterValue, float64(st.Resets))
+
+	buckets := make(map[float64]uint64, len(st.BatchLatency.Bounds))
+	for i, b := range st.BatchLatency.Bounds {
+		buckets[time.Duration(b).Seconds()] = uint64(st.BatchLatency.Buckets[i])
+	}
+	ch <- prometheus.MustNewConstHistogram(c.batchLatency,
+		uint64(st.BatchLatency.Count), time.Duration(st.BatchLatency.Sum).Seconds(), buckets)
+
+	ch <- histogram(c.batchRecords, st.BatchRecords)
+	ch <- histogram(c.batchBytes, st.BatchBytes)
+}
+
+// histogram converts a Histogram of the stats to a Prometheus one
+func histogram(desc *prometheus.Desc, h firehosePool.Histogram) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(h.Bounds))
+	for i, b := range h.Bounds {
+		buckets[float64(b)] = uint64(h.Buckets[i])
+	}
+	return prometheus.MustNewConstHistogram(desc, uint64(h.Count), float64(h.Sum), buckets)
+}
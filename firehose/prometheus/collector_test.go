@@ -0,0 +1,25 @@
+package firehoseProm
+
+import (
+	"testing"
+
+	firehosePool "github.com/gabrielperezs/streamspooler/firehose"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	c := New(&firehosePool.Server{}, prometheus.Labels{"stream": "test"})
+
+	if n := testutil.CollectAndCount(c); n != 14 {
+		t.Errorf("expected 14 metrics, got %d", n)
+	}
+
+	problems, err := testutil.CollectAndLint(c)
+	if err != nil {
+		t.Fatalf("lint: %s", err)
+	}
+	for _, p := range problems {
+		t.Errorf("lint %s: %s", p.Metric, p.Text)
+	}
+}
@@ -0,0 +1,68 @@
+package firehosePool
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrUnknownStream is returned when the router has no pool for the stream
+var ErrUnknownStream = errors.New("firehose stream not in the router")
+
+// Router sends the records to several delivery streams, with one pool for
+// every stream
+type Router struct {
+	servers map[string]*Server
+	route   func(record interface{}) string
+}
+
+// NewRouter creates a pool for every config, identified by its StreamName.
+// route chooses the stream of the records sent with Send, it can be nil
+// if only SendTo is used.
+func NewRouter(ctx context.Context, route func(record interface{}) string, cfgs ...Config) *Router {
+	r := &Router{
+		servers: make(map[string]*Server, len(cfgs)),
+		route:   route,
+	}
+
+	for _, cfg := range cfgs {
+		r.servers[cfg.StreamName] = NewWithContext(ctx, cfg)
+	}
+
+	return r
+}
+
+// Server returns the pool of the stream, nil if it isn't in the router
+func (r *Router) Server(stream string) *Server {
+	return r.servers[stream]
+}
+
+// SendTo puts the record in the buffer of the stream pool, see SendWithContext
+func (r *Router) SendTo(ctx context.Context, stream string, record interface{}) error {
+	srv, ok := r.servers[stream]
+	if !ok {
+		return ErrUnknownStream
+	}
+	return srv.SendWithContext(ctx, record)
+}
+
+// Send puts the record in the buffer of the stream chosen by the route function
+func (r *Router) Send(ctx context.Context, record interface{}) error {
+	if r.route == nil {
+		return ErrUnknownStream
+	}
+	return r.SendTo(ctx, r.route(record), record)
+}
+
+// Exit terminates all the pools of the router
+func (r *Router) Exit() {
+	var wg sync.WaitGroup
+	for _, srv := range r.servers {
+		wg.Add(1)
+		go func(srv *Server) {
+			defer wg.Done()
+			srv.Exit()
+		}(srv)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,27 @@
+package firehosePool
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	a, b := newTestServer(1), newTestServer(1)
+	r := &Router{
+		servers: map[string]*Server{"a": a, "b": b},
+		route: func(record interface{}) string {
+			return string(record.([]byte)[:1])
+		},
+	}
+
+	if err := r.Send(context.Background(), []byte("b record")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(a.C) != 0 || len(b.C) != 1 {
+		t.Errorf("the record must go to the stream b")
+	}
+
+	if err := r.SendTo(context.Background(), "c", []byte("record")); err != ErrUnknownStream {
+		t.Errorf("expected %s, got %v", ErrUnknownStream, err)
+	}
+}
@@ -0,0 +1,49 @@
+package firehosePool
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleSignals drains the pool on SIGTERM or SIGINT: it flushes the records
+// waiting up to FlushTimeout, closes the pool and cancels the returned
+// context, so the program can return once it's done. The signals are handled
+// until the context or the pool are done.
+func (srv *Server) HandleSignals(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		defer cancel()
+		defer signal.Stop(ch)
+
+		select {
+		case sig := <-ch:
+			srv.drain(sig)
+		case <-ctx.Done():
+		case <-srv.Done():
+		}
+	}()
+
+	return ctx
+}
+
+// drain flushes and closes the pool after the signal
+func (srv *Server) drain(sig os.Signal) {
+	srv.Lock()
+	timeout := srv.cfg.FlushTimeout
+	srv.Unlock()
+
+	srv.logf(LogInfo, "Firehose: %s received, flushing the records", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Flush(ctx); err != nil {
+		srv.logf(LogError, "Firehose ERROR: flush on %s: %s", sig, err)
+	}
+	srv.Close()
+}
@@ -0,0 +1,46 @@
+//go:build !windows
+
+package firehosePool
+
+import (
+	"context"
+	"io"
+	"log"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandleSignals(t *testing.T) {
+	srv, err := Connect(context.Background(), Config{
+		StreamName:   "test",
+		DryRun:       true,
+		FlushTimeout: time.Second,
+		Logger:       log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ctx := srv.HandleSignals(context.Background())
+
+	if err := srv.SendWithContext(context.Background(), []byte("record")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the context was not cancelled")
+	}
+	select {
+	case <-srv.Done():
+	default:
+		t.Errorf("the pool must be closed before cancelling")
+	}
+	if s := srv.Stats(); s.RecordsSent != 1 {
+		t.Errorf("expected the record sent, got %d", s.RecordsSent)
+	}
+}
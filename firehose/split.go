@@ -0,0 +1,94 @@
+package firehosePool
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// SplitLines is a SplitFunc that splits the record in lines, the empty
+// ones are removed
+func SplitLines(b []byte) [][]byte {
+	var lines [][]byte
+	for _, line := range bytes.SplitAfter(b, newLine) {
+		if len(line) > 1 || (len(line) == 1 && line[0] != '\n') {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// sendSplit sends as several records the parts of a record over the size
+// limit. The parts that are still too large are discarded. The callback of
+// the record, if any, is called once with the first error after all the
+// parts were sent or discarded. If a part can't be put in the buffer the
+// error is returned, the parts already in the buffer are sent anyway and the
+// callback is still called with the error once they finish.
+func (srv *Server) sendSplit(ctx context.Context, b []byte, item interface{}, nowait bool) error {
+	// A record that can't be split is rejected like without SplitFunc
+	split := srv.conf().SplitFunc(b)
+	if len(split) == 1 && len(split[0]) == len(b) {
+		return ErrRecordTooLarge
+	}
+
+	var parts [][]byte
+	var tooLarge bool
+	for _, p := range split {
+		if srv.framedLen(p) > srv.conf().MaxRecordSize {
+			srv.discardRaw(p, ErrRecordTooLarge)
+			tooLarge = true
+			continue
+		}
+		parts = append(parts, p)
+	}
+	if len(parts) == 0 {
+		return ErrRecordTooLarge
+	}
+
+	var fn func(error)
+	var finish func(n int, err error) // Counts n parts done with err
+	var rctx context.Context
+	cr, ok := item.(*callbackRecord)
+	if ok {
+		rctx = cr.ctx
+	}
+	if ok && cr.fn != nil {
+		var (
+			mu      sync.Mutex
+			pending = len(parts)
+			first   error
+		)
+		if tooLarge {
+			first = ErrRecordTooLarge
+		}
+		finish = func(n int, err error) {
+			mu.Lock()
+			if first == nil {
+				first = err
+			}
+			pending -= n
+			done := pending == 0
+			mu.Unlock()
+			if done {
+				cr.fn(first)
+			}
+		}
+		fn = func(err error) { finish(1, err) }
+	}
+
+	for i, p := range parts {
+		var item interface{} = p
+		if fn != nil || rctx != nil {
+			item = &callbackRecord{record: p, fn: fn, ctx: rctx}
+		}
+		if err := srv.put(ctx, p, item, nowait); err != nil {
+			// The parts already in the buffer are sent anyway, the callback
+			// waits only for them. Without any it's not called, like Send.
+			if finish != nil && i > 0 {
+				finish(len(parts)-i, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package firehosePool
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSplitLines(t *testing.T) {
+	lines := SplitLines([]byte("a\n\nb\nc"))
+	if len(lines) != 3 || string(lines[0]) != "a\n" || string(lines[1]) != "b\n" || string(lines[2]) != "c" {
+		t.Errorf("unexpected lines %q", lines)
+	}
+}
+
+func TestSendSplit(t *testing.T) {
+	srv := newTestServer(4)
+	srv.cfg.MaxRecordSize = 10
+	srv.cfg.SplitFunc = SplitLines
+	var dropped []string
+	srv.cfg.OnDrop = func(data []byte) {
+		dropped = append(dropped, string(data))
+	}
+
+	var results []error
+	record := []byte("aaaa\nbbbb\ncccccccccccccc\n")
+	if err := srv.SendWithCallback(context.Background(), record, func(err error) {
+		results = append(results, err)
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(srv.C) != 2 || len(dropped) != 1 || dropped[0] != "cccccccccccccc\n" {
+		t.Fatalf("expected 2 records and 1 dropped, got %d, %q", len(srv.C), dropped)
+	}
+	for i := 0; i < 2; i++ {
+		cr := (<-srv.C).(*callbackRecord)
+		cr.fn(nil)
+	}
+	if len(results) != 1 || results[0] != ErrRecordTooLarge {
+		t.Errorf("expected one callback with %s, got %v", ErrRecordTooLarge, results)
+	}
+
+	// Nothing to send
+	if err := srv.SendWithContext(context.Background(), []byte("cccccccccccccc\n")); err != ErrRecordTooLarge {
+		t.Errorf("expected %s, got %v", ErrRecordTooLarge, err)
+	}
+}
+
+func TestSplitDefault(t *testing.T) {
+	srv := newTestServer(4)
+	var dropped int
+	srv.Reload(&Config{StreamName: "test", DryRun: true, MaxRecordSize: 8, OnDrop: func([]byte) { dropped++ }})
+	defer srv.Exit()
+
+	// The lines are sent in their own records by default
+	if err := srv.SendWithContext(context.Background(), []byte("aaaa\nbbbb\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(srv.C) != 2 {
+		t.Errorf("expected 2 records, got %d", len(srv.C))
+	}
+
+	// One that can't be split is rejected without dropping it
+	if err := srv.SendWithContext(context.Background(), []byte("aaaaaaaaaaaa")); err != ErrRecordTooLarge {
+		t.Errorf("expected %s, got %v", ErrRecordTooLarge, err)
+	}
+	if dropped != 0 {
+		t.Errorf("expected nothing dropped, got %d", dropped)
+	}
+}
+
+func TestSendSplitBufferFull(t *testing.T) {
+	srv := newTestServer(1)
+	srv.cfg.MaxRecordSize = 10
+	srv.cfg.SplitFunc = SplitLines
+
+	// The buffer fills after the first part
+	var results []error
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := srv.SendWithCallback(ctx, []byte("aaaa\nbbbb\ncccc\n"), func(err error) {
+		results = append(results, err)
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+	if len(results) != 0 {
+		t.Fatalf("unexpected callback before the part in the buffer was sent: %v", results)
+	}
+
+	cr := (<-srv.C).(*callbackRecord)
+	cr.fn(nil)
+	if len(results) != 1 || results[0] != context.DeadlineExceeded {
+		t.Errorf("expected one callback with %s, got %v", context.DeadlineExceeded, results)
+	}
+
+	// Nothing in the buffer, the callback is not called
+	srv.C <- []byte("full")
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := srv.SendWithCallback(ctx, []byte("aaaa\nbbbb\n"), func(err error) {
+		t.Errorf("unexpected callback with %v", err)
+	}); err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,255 @@
+package firehosePool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	spoolSegmentSize = 16 << 20 // Size of a segment before writing a new one
+	spoolExt         = ".wal"
+)
+
+// spool is a write ahead log of the records in SpoolDir, the records are
+// appended to segment files that are removed once all their records were
+// sent or discarded. The records of the segments found when opening it are
+// sent again, so a record could be sent twice after a restart. The records
+// are written without syncing the file, they survive a crash of the process
+// but not always one of the system, a segment is synced once it's closed.
+type spool struct {
+	sync.Mutex
+	dir         string
+	segmentSize int64
+	seq         int64 // Segment being written
+	file        *os.File
+	size        int64
+	segments    map[int64]*segment
+	corrupted   []string // Segments with an invalid record when opened, the rest of them was skipped
+}
+
+// segment counts the records of a file of the spool
+type segment struct {
+	written int
+	done    int
+	closed  bool // No more records will be written
+}
+
+// spoolEntry is a record read from the spool
+type spoolEntry struct {
+	seq  int64
+	data []byte
+}
+
+// openSpool opens the spool in the directory and returns the records that
+// were not sent by a previous pool
+func openSpool(dir string) (*spool, []spoolEntry, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolExt))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &spool{
+		dir:         dir,
+		segmentSize: spoolSegmentSize,
+		segments:    make(map[int64]*segment),
+	}
+
+	var seqs []int64
+	for _, f := range files {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(f), spoolExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	var entries []spoolEntry
+	for _, seq := range seqs {
+		records, corrupted, err := readSegment(s.path(seq))
+		if err != nil {
+			return nil, nil, err
+		}
+		if corrupted {
+			s.corrupted = append(s.corrupted, s.path(seq))
+		}
+		if len(records) == 0 {
+			os.Remove(s.path(seq))
+			continue
+		}
+		s.segments[seq] = &segment{written: len(records), closed: true}
+		for _, r := range records {
+			entries = append(entries, spoolEntry{seq: seq, data: r})
+		}
+		s.seq = seq
+	}
+
+	if err := s.create(s.seq + 1); err != nil {
+		return nil, nil, err
+	}
+
+	return s, entries, nil
+}
+
+// readSegment reads the records of a segment, a truncated record at the
+// end of the file is ignored. A length over the Firehose limit can't be
+// written by append, the segment is corrupted and it's read until there.
+func readSegment(path string) (records [][]byte, corrupted bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			break
+		}
+		n := binary.BigEndian.Uint32(header[:])
+		if n > maxRecordSize {
+			return records, true, nil
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			break
+		}
+		records = append(records, b)
+	}
+	return records, false, nil
+}
+
+func (s *spool) path(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolExt))
+}
+
+// create starts a new segment
+func (s *spool) create(seq int64) error {
+	file, err := os.OpenFile(s.path(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.seq = seq
+	s.file = file
+	s.size = 0
+	s.segments[seq] = &segment{}
+	return nil
+}
+
+// closeSegment syncs and closes the segment being written, it's removed if
+// all its records were already sent
+func (s *spool) closeSegment() error {
+	err := s.file.Sync()
+	if e := s.file.Close(); err == nil {
+		err = e
+	}
+	seg := s.segments[s.seq]
+	seg.closed = true
+	s.compact(s.seq, seg)
+	return err
+}
+
+// append writes the record in the spool and returns its segment, records
+// over the Firehose limit are rejected with ErrRecordTooLarge
+func (s *spool) append(b []byte) (int64, error) {
+	if len(b) > maxRecordSize {
+		return 0, ErrRecordTooLarge
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.size >= s.segmentSize {
+		if err := s.closeSegment(); err != nil {
+			return 0, err
+		}
+		if err := s.create(s.seq + 1); err != nil {
+			return 0, err
+		}
+	}
+
+	// Written directly to the file so it survives a crash of the process
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(b)))
+	if _, err := s.file.Write(header[:]); err != nil {
+		return 0, err
+	}
+	if _, err := s.file.Write(b); err != nil {
+		return 0, err
+	}
+
+	s.size += int64(len(header) + len(b))
+	s.segments[s.seq].written++
+	return s.seq, nil
+}
+
+// done marks a record of the segment as sent or discarded
+func (s *spool) done(seq int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	seg, ok := s.segments[seq]
+	if !ok {
+		return
+	}
+	seg.done++
+	s.compact(seq, seg)
+}
+
+// result marks a record of the segment as done with the result of its
+// callback. The records dropped with ErrExiting are kept, they are sent again
+// when the spool is opened by the next pool.
+func (s *spool) result(seq int64, err error) {
+	if errors.Is(err, ErrExiting) {
+		return
+	}
+	s.done(seq)
+}
+
+// compact removes the segment if all its records are done
+func (s *spool) compact(seq int64, seg *segment) {
+	if !seg.closed || seg.done < seg.written {
+		return
+	}
+	delete(s.segments, seq)
+	os.Remove(s.path(seq))
+}
+
+// close the segment being written, the records not sent yet are kept
+func (s *spool) close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.closeSegment()
+}
+
+// spooled wraps the item so the record is marked as done in the spool
+// once it's sent or discarded
+func (s *spool) spooled(item, record interface{}, seq int64) interface{} {
+	if cr, ok := item.(*callbackRecord); ok {
+		fn := cr.fn
+		return &callbackRecord{record: record, ctx: cr.ctx, fn: func(err error) {
+			s.result(seq, err)
+			if fn != nil {
+				fn(err)
+			}
+		}}
+	}
+	return &callbackRecord{record: record, fn: func(err error) {
+		s.result(seq, err)
+	}}
+}
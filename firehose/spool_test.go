@@ -0,0 +1,153 @@
+package firehosePool
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+
+	s, entries, err := openSpool(dir)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected an empty spool, got %d records", len(entries))
+	}
+	s.segmentSize = 10
+
+	first, _ := s.append([]byte("first record"))
+	second, _ := s.append([]byte("second"))
+	s.append([]byte("third"))
+	if first == second {
+		t.Errorf("expected a new segment after %d bytes", s.segmentSize)
+	}
+
+	// The first segment is removed once its record was sent
+	s.done(first)
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+spoolExt)); len(files) != 2 {
+		t.Errorf("expected 2 segments, got %d", len(files))
+	}
+	s.close()
+
+	s, entries, err = openSpool(dir)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer s.close()
+	if len(entries) != 2 || string(entries[0].data) != "second" || string(entries[1].data) != "third" {
+		t.Errorf("unexpected records %v", entries)
+	}
+}
+
+func TestSendSpool(t *testing.T) {
+	srv := newTestServer(1)
+	s, _, err := openSpool(t.TempDir())
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer s.close()
+	srv.spool = s
+
+	var result error = ErrExiting
+	if err := srv.SendWithCallback(context.Background(), []byte("record"), func(err error) { result = err }); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if w := s.segments[s.seq].written; w != 1 {
+		t.Errorf("expected 1 record in the spool, got %d", w)
+	}
+
+	// The client calls the callback once the record is sent
+	(<-srv.C).(*callbackRecord).fn(nil)
+	if result != nil || s.segments[s.seq].done != 1 {
+		t.Errorf("expected the record done in the spool and the callback called")
+	}
+}
+
+func TestSpoolCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	s, _, err := openSpool(dir)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	if _, err := s.append(make([]byte, maxRecordSize+1)); err != ErrRecordTooLarge {
+		t.Errorf("expected %s, got %v", ErrRecordTooLarge, err)
+	}
+	s.append([]byte("first"))
+	path := s.path(s.seq)
+	s.close()
+
+	// A length over the limit and a record after it
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("open segment: %s", err)
+	}
+	f.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Write([]byte{0, 0, 0, 4, 'l', 'o', 's', 't'})
+	f.Close()
+
+	s, entries, err := openSpool(dir)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer s.close()
+	if len(entries) != 1 || string(entries[0].data) != "first" {
+		t.Errorf("expected the records before the corruption, got %v", entries)
+	}
+	if len(s.corrupted) != 1 || s.corrupted[0] != path {
+		t.Errorf("expected the segment %s corrupted, got %v", path, s.corrupted)
+	}
+}
+
+func TestSpoolKeptOnExit(t *testing.T) {
+	dir := t.TempDir()
+	fake := &fakeAPI{status: types.DeliveryStreamStatusActive, hang: true}
+	cfg := Config{
+		StreamName:    "test",
+		SpoolDir:      dir,
+		MaxRecords:    5,
+		FlushInterval: time.Minute,
+		FlushTimeout:  50 * time.Millisecond,
+		BatchTimeout:  time.Minute,
+		FirehoseAPI:   fake,
+	}
+	srv, err := Connect(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := srv.Send([]byte("record")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// The batch hangs until Exit gives up and discards it with ErrExiting
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		fake.mu.Lock()
+		calls := fake.calls
+		fake.mu.Unlock()
+		if calls > 0 {
+			break
+		}
+	}
+	srv.Close()
+	if n := srv.Stats().RecordsDropped; n != 5 {
+		t.Fatalf("expected 5 records dropped, got %d", n)
+	}
+
+	// The records that couldn't be sent are replayed by the next pool
+	s, entries, err := openSpool(dir)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer s.close()
+	if len(entries) != 5 {
+		t.Errorf("expected the 5 records kept in the spool, got %d", len(entries))
+	}
+}
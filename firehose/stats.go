@@ -0,0 +1,332 @@
+package firehosePool
+
+import (
+	"sync/atomic"
+	"time"
+
+	compress "github.com/gallir/smart-relayer/redis"
+)
+
+const maxHistogramBuckets = 16
+
+// latencyBounds are the upper bounds, in nanoseconds, of the buckets of the
+// PutRecordBatch latency histogram
+var latencyBounds = []int64{
+	int64(10 * time.Millisecond),
+	int64(25 * time.Millisecond),
+	int64(50 * time.Millisecond),
+	int64(100 * time.Millisecond),
+	int64(250 * time.Millisecond),
+	int64(500 * time.Millisecond),
+	int64(1 * time.Second),
+	int64(2500 * time.Millisecond),
+	int64(5 * time.Second),
+	int64(10 * time.Second),
+}
+
+// batchRecordsBounds are the upper bounds of the buckets of the Firehose
+// records per PutRecordBatch histogram
+var batchRecordsBounds = []int64{1, 5, 10, 25, 50, 100, 250, maxBatchRecords}
+
+// batchBytesBounds are the upper bounds of the buckets of the bytes per
+// PutRecordBatch histogram
+var batchBytesBounds = []int64{1 << 10, 16 << 10, 64 << 10, 256 << 10, 512 << 10, 1 << 20, 2 << 20, maxBatchSize}
+
+// Stats are the counters of the pool since it was created
+type Stats struct {
+	RecordsSent     int64 // Firehose records accepted by the stream
+	BytesSent       int64 // Bytes of the records accepted by the stream
+	RecordsFailed   int64 // Firehose records rejected in a PutRecordBatch partial failure
+	BatchesFailed   int64 // PutRecordBatch calls that failed completely
+	BatchesTimedOut int64 // PutRecordBatch calls that failed because of BatchTimeout, they are in BatchesFailed too
+	RecordsDropped  int64 // Records discarded without being sent
+	RecordsRejected int64 // Records that Send couldn't put in the buffer, e.g. full or exiting
+	RecordsDeduped  int64 // Records skipped because they were seen within DedupWindow
+	FailedLost      int64 // Discarded records not published because ErrChan was full
+	ActiveClients   int64 // Clients currently running
+
+	// The pool is failing while it can't connect to the stream and after the
+	// errors went over MaxErrors, until a batch is sent. Resets counts the
+	// times the connection and the clients were replaced, e.g. because of the
+	// errors or MaxConnectionAge, they don't always mean the pool was failing.
+	FailingEpisodes int64         // Times the pool started failing
+	FailingTime     time.Duration // Time spent failing, including the current episode
+	Resets          int64         // Times the clients were replaced by the ones of a new connection
+
+	BatchLatency Histogram // Duration of the PutRecordBatch calls in nanoseconds
+	BatchRecords Histogram // Firehose records of the PutRecordBatch calls
+	BatchBytes   Histogram // Bytes of the PutRecordBatch calls
+}
+
+// ClientStats are the counters of one client of the pool
+type ClientStats struct {
+	ID            int64
+	RecordsSent   int64 // Firehose records accepted by the stream
+	RecordsFailed int64 // Firehose records rejected in a PutRecordBatch partial failure
+	BatchesFailed int64 // PutRecordBatch calls that failed completely
+	Queued        int   // Records in the buffer of the client
+	Pending       int64 // Records in the batch being built
+	Failing       bool  // The last PutRecordBatch call failed or some records were rejected
+}
+
+// clientCounters are the counters of a client, updated with atomics and
+// copied to ClientStats by Server.Clients
+type clientCounters struct {
+	recordsSent   int64
+	recordsFailed int64
+	batchesFailed int64
+	pending       int64
+	failing       int32
+}
+
+// Histogram is a snapshot of the distribution of a value, Buckets has the
+// cumulative count of the observations less or equal than each of the Bounds
+type Histogram struct {
+	Count   int64
+	Sum     int64
+	Min     int64
+	Max     int64
+	Bounds  []int64
+	Buckets []int64
+}
+
+// histogram keeps the observations of a value using atomics, the bounds are
+// given on every call so the zero value is ready to use
+type histogram struct {
+	count   int64
+	sum     int64
+	min     int64 // Stored plus one, so zero is no observations
+	max     int64
+	buckets [maxHistogramBuckets]int64
+}
+
+func (h *histogram) observe(bounds []int64, v int64) {
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, v)
+	for {
+		m := atomic.LoadInt64(&h.min)
+		if (m != 0 && m <= v+1) || atomic.CompareAndSwapInt64(&h.min, m, v+1) {
+			break
+		}
+	}
+	for {
+		m := atomic.LoadInt64(&h.max)
+		if m >= v || atomic.CompareAndSwapInt64(&h.max, m, v) {
+			break
+		}
+	}
+	for i, b := range bounds {
+		if v <= b {
+			atomic.AddInt64(&h.buckets[i], 1)
+			return
+		}
+	}
+}
+
+func (h *histogram) snapshot(bounds []int64) Histogram {
+	s := Histogram{
+		Count:   atomic.LoadInt64(&h.count),
+		Sum:     atomic.LoadInt64(&h.sum),
+		Max:     atomic.LoadInt64(&h.max),
+		Bounds:  bounds,
+		Buckets: make([]int64, len(bounds)),
+	}
+	if m := atomic.LoadInt64(&h.min); m > 0 {
+		s.Min = m - 1
+	}
+	var c int64
+	for i := range bounds {
+		c += atomic.LoadInt64(&h.buckets[i])
+		s.Buckets[i] = c
+	}
+	return s
+}
+
+// Stats returns a snapshot of the counters, it's lock free so it can be
+// called as often as needed
+func (srv *Server) Stats() Stats {
+	return Stats{
+		RecordsSent:     atomic.LoadInt64(&srv.stats.RecordsSent),
+		BytesSent:       atomic.LoadInt64(&srv.stats.BytesSent),
+		RecordsFailed:   atomic.LoadInt64(&srv.stats.RecordsFailed),
+		BatchesFailed:   atomic.LoadInt64(&srv.stats.BatchesFailed),
+		BatchesTimedOut: atomic.LoadInt64(&srv.stats.BatchesTimedOut),
+		RecordsDropped:  atomic.LoadInt64(&srv.stats.RecordsDropped),
+		RecordsRejected: atomic.LoadInt64(&srv.stats.RecordsRejected),
+		RecordsDeduped:  atomic.LoadInt64(&srv.stats.RecordsDeduped),
+		FailedLost:      atomic.LoadInt64(&srv.stats.FailedLost),
+		ActiveClients:   atomic.LoadInt64(&srv.stats.ActiveClients),
+		FailingEpisodes: atomic.LoadInt64(&srv.stats.FailingEpisodes),
+		FailingTime:     srv.failingDuration(),
+		Resets:          atomic.LoadInt64(&srv.stats.Resets),
+		BatchLatency:    srv.latency.snapshot(latencyBounds),
+		BatchRecords:    srv.batchRecords.snapshot(batchRecordsBounds),
+		BatchBytes:      srv.batchBytes.snapshot(batchBytesBounds),
+	}
+}
+
+// setFailing records when the pool starts and stops failing, it's called
+// with the lock
+func (srv *Server) setFailing(failing bool) {
+	if srv.failing.Load() == failing {
+		return
+	}
+
+	now := srv.now().UnixNano()
+	if failing {
+		atomic.AddInt64(&srv.stats.FailingEpisodes, 1)
+		atomic.StoreInt64(&srv.failingSince, now)
+		srv.failing.Store(true)
+		return
+	}
+	srv.failing.Store(false)
+	atomic.AddInt64(&srv.failingTime, now-atomic.LoadInt64(&srv.failingSince))
+}
+
+// failingDuration returns the time failing of the finished episodes and the
+// current one
+func (srv *Server) failingDuration() time.Duration {
+	d := atomic.LoadInt64(&srv.failingTime)
+	if srv.failing.Load() {
+		d += srv.now().UnixNano() - atomic.LoadInt64(&srv.failingSince)
+	}
+	return time.Duration(d)
+}
+
+// Clients returns a snapshot of the counters of every running client
+func (srv *Server) Clients() []ClientStats {
+	srv.Lock()
+	clients := make([]*Client, len(srv.clients))
+	copy(clients, srv.clients)
+	srv.Unlock()
+
+	stats := make([]ClientStats, 0, len(clients))
+	for _, c := range clients {
+		stats = append(stats, ClientStats{
+			ID:            c.ID,
+			RecordsSent:   atomic.LoadInt64(&c.stats.recordsSent),
+			RecordsFailed: atomic.LoadInt64(&c.stats.recordsFailed),
+			BatchesFailed: atomic.LoadInt64(&c.stats.batchesFailed),
+			Queued:        len(c.C),
+			Pending:       atomic.LoadInt64(&c.stats.pending),
+			Failing:       atomic.LoadInt32(&c.stats.failing) == 1,
+		})
+	}
+	return stats
+}
+
+// discardRaw discards a record that wasn't compressed nor framed yet, it's
+// reported encoded like the clients would have sent it so Replay can send it
+// again. It's only encoded when there is someone to report it to.
+func (srv *Server) discardRaw(b []byte, err error) {
+	if cfg := srv.conf(); b != nil && (cfg.ErrChan != nil || cfg.OnDrop != nil) {
+		b = srv.encodeFailed(b)
+	}
+	srv.discard(b, err)
+}
+
+// encodeFailed compresses and frames a record like process and appendBuff
+// do, a record that the Compression fails on is left uncompressed
+func (srv *Server) encodeFailed(b []byte) []byte {
+	cfg := srv.conf()
+	if cfg.SkipCompressed && cfg.Compression == CompressionGzip && isGzip(b) {
+		return b
+	}
+	if cfg.Compress {
+		b = compress.Bytes(b)
+	}
+	b = srv.frame(nil, b)
+	if c := compressor(cfg.Compression); c != nil {
+		if out, err := c.Compress(nil, b); err == nil {
+			b = out
+		}
+	}
+	return b
+}
+
+// discard counts a record that won't be sent and publish a copy in ErrChan,
+// it never blocks: if the channel is full the failed record is lost
+func (srv *Server) discard(b []byte, err error) {
+	atomic.AddInt64(&srv.stats.RecordsDropped, 1)
+
+	cfg := srv.conf()
+	if cfg.OnDrop != nil {
+		cfg.OnDrop(b)
+	}
+
+	if cfg.ErrChan == nil {
+		return
+	}
+
+	var data []byte
+	if b != nil {
+		data = make([]byte, len(b))
+		copy(data, b)
+	}
+
+	select {
+	case cfg.ErrChan <- FailedRecord{Data: data, Err: err}:
+	default:
+		atomic.AddInt64(&srv.stats.FailedLost, 1)
+	}
+}
+
+// lose discards the records left in the shared buffer and in the ones of the
+// clients when the pool exits, it returns how many. Their callbacks are not
+// called so the spooled ones are sent again on restart.
+func (srv *Server) lose(clients []*Client) int {
+	var n int
+	for _, ch := range append([]chan interface{}{srv.C}, clientBuffers(clients)...) {
+		for empty := false; !empty; {
+			select {
+			case item := <-ch:
+				srv.discardItem(item, ErrExiting)
+				n++
+			default:
+				empty = true
+			}
+		}
+	}
+	return n
+}
+
+// clientBuffers returns the buffers of the clients
+func clientBuffers(clients []*Client) []chan interface{} {
+	buffers := make([]chan interface{}, 0, len(clients))
+	for _, c := range clients {
+		buffers = append(buffers, c.C)
+	}
+	return buffers
+}
+
+// evict discards an item of the buffer and calls its callbacks
+func (srv *Server) evict(item interface{}, err error) {
+	for _, fn := range srv.discardItem(item, err) {
+		fn(err)
+	}
+}
+
+// discardItem discards an item of the buffer, releases its bytes and
+// returns its callbacks
+func (srv *Server) discardItem(item interface{}, err error) []func(error) {
+	var callbacks []func(error)
+	if cr, ok := item.(*callbackRecord); ok {
+		item = cr.record
+		if cr.fn != nil {
+			callbacks = []func(error){cr.fn}
+		}
+	}
+
+	switch r := item.(type) {
+	case *retryRecord:
+		srv.discard(r.b, err)
+		srv.release(r.bytes)
+		callbacks = r.callbacks
+	case []byte:
+		srv.discardRaw(r, err)
+		srv.release(int64(len(r)))
+	default:
+		srv.discard(nil, err)
+	}
+	return callbacks
+}
@@ -0,0 +1,126 @@
+package firehosePool
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	bounds := []int64{10, 100}
+
+	if s := h.snapshot(bounds); s.Count != 0 || s.Min != 0 || s.Max != 0 {
+		t.Errorf("unexpected empty snapshot %+v", s)
+	}
+
+	for _, v := range []int64{50, 0, 500, 5} {
+		h.observe(bounds, v)
+	}
+
+	s := h.snapshot(bounds)
+	if s.Count != 4 || s.Sum != 555 || s.Min != 0 || s.Max != 500 {
+		t.Errorf("unexpected snapshot %+v", s)
+	}
+	if s.Buckets[0] != 2 || s.Buckets[1] != 3 {
+		t.Errorf("unexpected buckets %v", s.Buckets)
+	}
+}
+
+func TestLose(t *testing.T) {
+	srv := newTestServer(3)
+	var dropped []string
+	srv.cfg.OnDrop = func(data []byte) {
+		dropped = append(dropped, string(data))
+	}
+
+	srv.C <- []byte("a")
+	srv.C <- &retryRecord{b: []byte("b\n")}
+	srv.C <- &callbackRecord{record: []byte("c"), fn: func(error) {
+		t.Error("the callbacks of lost records must not be called")
+	}}
+
+	// The buffers of the clients too
+	clt := &Client{C: make(chan interface{}, 1)}
+	clt.C <- []byte("d")
+
+	if n := srv.lose([]*Client{clt}); n != 4 {
+		t.Errorf("expected 4 records lost, got %d", n)
+	}
+	if len(dropped) != 4 || dropped[0] != "a\n" || dropped[1] != "b\n" || dropped[2] != "c\n" || dropped[3] != "d\n" {
+		t.Errorf("unexpected records dropped %q", dropped)
+	}
+	if n := srv.Stats().RecordsDropped; n != 4 {
+		t.Errorf("expected 4 records dropped, got %d", n)
+	}
+}
+
+func TestFailingTime(t *testing.T) {
+	clock := newFakeClock()
+	fake := &fakeAPI{status: types.DeliveryStreamStatusCreating}
+	srv := newTestServer(1)
+	srv.clock = clock
+	srv.cfg.StreamName = "test"
+	srv.cfg.ConnectTimeout = time.Second
+	srv.cfg.FirehoseAPI = fake
+	srv.cfg.FlushTimeout = time.Second
+	srv.cliDesired = 1
+	defer srv.Exit()
+
+	// Consecutive failures are one episode
+	for i := 0; i < 2; i++ {
+		if err := srv.clientsReset(); !errors.Is(err, ErrStreamNotActive) {
+			t.Fatalf("expected %s, got %v", ErrStreamNotActive, err)
+		}
+		clock.Advance(10 * time.Second)
+	}
+	if s := srv.Stats(); s.FailingEpisodes != 1 || s.FailingTime != 20*time.Second {
+		t.Errorf("expected 1 episode of 20s, got %d of %s", s.FailingEpisodes, s.FailingTime)
+	}
+
+	fake.status = types.DeliveryStreamStatusActive
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	clock.Advance(time.Minute)
+	if s := srv.Stats(); s.FailingEpisodes != 1 || s.FailingTime != 20*time.Second {
+		t.Errorf("expected the time stopped once connected, got %d of %s", s.FailingEpisodes, s.FailingTime)
+	}
+
+	// Too many errors start another one, it goes on after connecting again
+	srv.Lock()
+	srv.cfg.ErrorsFrame = time.Minute
+	srv.Unlock()
+	srv.failure(errors.New("failed"))
+	clock.Advance(5 * time.Second)
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	clock.Advance(5 * time.Second)
+	if s := srv.Stats(); s.FailingEpisodes != 2 || s.FailingTime != 30*time.Second || s.Resets != 1 {
+		t.Errorf("expected 2 episodes of 30s and 1 reset, got %d of %s and %d", s.FailingEpisodes, s.FailingTime, s.Resets)
+	}
+
+	// Until a batch is sent
+	srv.delivered()
+	clock.Advance(time.Minute)
+	if s := srv.Stats(); s.FailingEpisodes != 2 || s.FailingTime != 30*time.Second {
+		t.Errorf("expected the time stopped once delivered, got %d of %s", s.FailingEpisodes, s.FailingTime)
+	}
+}
+
+func TestClients(t *testing.T) {
+	srv := newTestServer(1)
+	clt := &Client{ID: 7, C: make(chan interface{}, 2)}
+	clt.C <- []byte("queued")
+	clt.stats.recordsSent = 3
+	clt.stats.failing = 1
+	srv.clients = []*Client{clt}
+
+	st := srv.Clients()
+	if len(st) != 1 || st[0].ID != 7 || st[0].RecordsSent != 3 || st[0].Queued != 1 || !st[0].Failing {
+		t.Errorf("unexpected client stats %+v", st)
+	}
+}
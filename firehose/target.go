@@ -0,0 +1,148 @@
+package firehosePool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	ktypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/spaolacci/murmur3"
+)
+
+// Targets of the pool
+const (
+	TargetFirehose = "firehose" // Firehose delivery stream, with PutRecordBatch
+	TargetKinesis  = "kinesis"  // Kinesis data stream, with PutRecords and a partition key per record
+)
+
+const kinesisThrottleError = "ProvisionedThroughputExceededException"
+
+// kinesisClient is the part of the Kinesis client used by the pool
+type kinesisClient interface {
+	DescribeStreamSummary(ctx context.Context, params *kinesis.DescribeStreamSummaryInput, optFns ...func(*kinesis.Options)) (*kinesis.DescribeStreamSummaryOutput, error)
+	PutRecords(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error)
+	PutRecord(ctx context.Context, params *kinesis.PutRecordInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordOutput, error)
+}
+
+// kinesisAPI is the API of the pool for a Kinesis data stream, the Firehose
+// calls of the clients are translated to the Kinesis ones and the errors to
+// the Firehose ones, so they are retried and classified the same way. The
+// Firehose request options don't apply to it.
+type kinesisAPI struct {
+	srv *Server
+	svc kinesisClient
+}
+
+// partitionKey returns the key of the record with the PartitionKey of the
+// config, the murmur3 hash of the record by default like kinesisPool
+func (a *kinesisAPI) partitionKey(b []byte) *string {
+	if fn := a.srv.conf().PartitionKey; fn != nil {
+		return aws.String(fn(b))
+	}
+	return aws.String(fmt.Sprintf("%02x", murmur3.Sum64(b)))
+}
+
+func (a *kinesisAPI) DescribeDeliveryStream(ctx context.Context, in *firehose.DescribeDeliveryStreamInput, _ ...func(*firehose.Options)) (*firehose.DescribeDeliveryStreamOutput, error) {
+	out, err := a.svc.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{StreamName: in.DeliveryStreamName})
+	if err != nil {
+		return nil, kinesisError(err)
+	}
+
+	s := out.StreamDescriptionSummary
+	d := &types.DeliveryStreamDescription{
+		DeliveryStreamName:   s.StreamName,
+		DeliveryStreamARN:    s.StreamARN,
+		DeliveryStreamStatus: kinesisStatus(s.StreamStatus),
+		DeliveryStreamType:   types.DeliveryStreamTypeDirectPut,
+	}
+	if s.EncryptionType == ktypes.EncryptionTypeKms {
+		d.DeliveryStreamEncryptionConfiguration = &types.DeliveryStreamEncryptionConfiguration{
+			KeyARN: s.KeyId,
+			Status: types.DeliveryStreamEncryptionStatusEnabled,
+		}
+	}
+	return &firehose.DescribeDeliveryStreamOutput{DeliveryStreamDescription: d}, nil
+}
+
+func (a *kinesisAPI) PutRecordBatch(ctx context.Context, in *firehose.PutRecordBatchInput, _ ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error) {
+	// Not nil, the empty batch of VerifyWrite is sent too
+	records := make([]ktypes.PutRecordsRequestEntry, 0, len(in.Records))
+	for _, r := range in.Records {
+		records = append(records, ktypes.PutRecordsRequestEntry{Data: r.Data, PartitionKey: a.partitionKey(r.Data)})
+	}
+
+	out, err := a.svc.PutRecords(ctx, &kinesis.PutRecordsInput{StreamName: in.DeliveryStreamName, Records: records})
+	if err != nil {
+		return nil, kinesisError(err)
+	}
+
+	res := &firehose.PutRecordBatchOutput{
+		FailedPutCount:   aws.Int32(aws.ToInt32(out.FailedRecordCount)),
+		RequestResponses: make([]types.PutRecordBatchResponseEntry, len(out.Records)),
+	}
+	for i, r := range out.Records {
+		if r.ErrorCode == nil {
+			res.RequestResponses[i].RecordId = r.SequenceNumber
+			continue
+		}
+		code := *r.ErrorCode
+		if code == kinesisThrottleError {
+			code = throttleError
+		}
+		res.RequestResponses[i].ErrorCode = aws.String(code)
+		res.RequestResponses[i].ErrorMessage = aws.String(aws.ToString(r.ErrorMessage))
+	}
+	return res, nil
+}
+
+func (a *kinesisAPI) PutRecord(ctx context.Context, in *firehose.PutRecordInput, _ ...func(*firehose.Options)) (*firehose.PutRecordOutput, error) {
+	out, err := a.svc.PutRecord(ctx, &kinesis.PutRecordInput{
+		StreamName:   in.DeliveryStreamName,
+		Data:         in.Record.Data,
+		PartitionKey: a.partitionKey(in.Record.Data),
+	})
+	if err != nil {
+		return nil, kinesisError(err)
+	}
+	return &firehose.PutRecordOutput{RecordId: out.SequenceNumber}, nil
+}
+
+// kinesisStatus returns the Firehose status of a Kinesis stream, an updating
+// stream still accepts records
+func kinesisStatus(status ktypes.StreamStatus) types.DeliveryStreamStatus {
+	switch status {
+	case ktypes.StreamStatusActive, ktypes.StreamStatusUpdating:
+		return types.DeliveryStreamStatusActive
+	case ktypes.StreamStatusCreating:
+		return types.DeliveryStreamStatusCreating
+	case ktypes.StreamStatusDeleting:
+		return types.DeliveryStreamStatusDeleting
+	}
+	return types.DeliveryStreamStatus(status)
+}
+
+// kinesisError returns the Firehose error of the Kinesis ones that the pool
+// handles differently, the rest are returned as they are
+func kinesisError(err error) error {
+	var (
+		notFound  *ktypes.ResourceNotFoundException
+		invalid   *ktypes.InvalidArgumentException
+		throttled *ktypes.ProvisionedThroughputExceededException
+		kms       *ktypes.KMSThrottlingException
+	)
+	switch {
+	case errors.As(err, &notFound):
+		return &types.ResourceNotFoundException{Message: notFound.Message}
+	case errors.As(err, &invalid):
+		return &types.InvalidArgumentException{Message: invalid.Message}
+	case errors.As(err, &throttled):
+		return &types.ServiceUnavailableException{Message: throttled.Message}
+	case errors.As(err, &kms):
+		return &types.ServiceUnavailableException{Message: kms.Message}
+	}
+	return err
+}
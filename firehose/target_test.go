@@ -0,0 +1,154 @@
+package firehosePool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	ktypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/spaolacci/murmur3"
+)
+
+// fakeKinesis is a Kinesis data stream that accepts all the records, except
+// the ones with the data in reject
+type fakeKinesis struct {
+	mu      sync.Mutex
+	status  ktypes.StreamStatus
+	missing bool
+	reject  string
+	records []ktypes.PutRecordsRequestEntry
+}
+
+func (f *fakeKinesis) DescribeStreamSummary(ctx context.Context, in *kinesis.DescribeStreamSummaryInput, _ ...func(*kinesis.Options)) (*kinesis.DescribeStreamSummaryOutput, error) {
+	if f.missing {
+		return nil, &ktypes.ResourceNotFoundException{Message: aws.String("not found")}
+	}
+	return &kinesis.DescribeStreamSummaryOutput{StreamDescriptionSummary: &ktypes.StreamDescriptionSummary{
+		StreamName:     in.StreamName,
+		StreamARN:      aws.String("arn:aws:kinesis:eu-west-1:123456789012:stream/" + *in.StreamName),
+		StreamStatus:   f.status,
+		EncryptionType: ktypes.EncryptionTypeKms,
+		KeyId:          aws.String("alias/aws/kinesis"),
+	}}, nil
+}
+
+func (f *fakeKinesis) PutRecords(ctx context.Context, in *kinesis.PutRecordsInput, _ ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int32(0)}
+	for _, r := range in.Records {
+		if string(r.Data) == f.reject {
+			*out.FailedRecordCount++
+			out.Records = append(out.Records, ktypes.PutRecordsResultEntry{ErrorCode: aws.String(kinesisThrottleError)})
+			continue
+		}
+		f.records = append(f.records, r)
+		out.Records = append(out.Records, ktypes.PutRecordsResultEntry{SequenceNumber: aws.String("1")})
+	}
+	return out, nil
+}
+
+func (f *fakeKinesis) PutRecord(ctx context.Context, in *kinesis.PutRecordInput, _ ...func(*kinesis.Options)) (*kinesis.PutRecordOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records = append(f.records, ktypes.PutRecordsRequestEntry{Data: in.Data, PartitionKey: in.PartitionKey})
+	return &kinesis.PutRecordOutput{SequenceNumber: aws.String("1")}, nil
+}
+
+func TestKinesisTarget(t *testing.T) {
+	fake := &fakeKinesis{status: ktypes.StreamStatusUpdating}
+	srv := newTestServer(10)
+	srv.Reload(&Config{
+		StreamName:        "test",
+		Target:            TargetKinesis,
+		MinWorkers:        1,
+		MaxWorkers:        1,
+		RequireEncryption: true,
+		PartitionKey:      func(b []byte) string { return "key-" + string(b[:1]) },
+		FirehoseAPI:       &kinesisAPI{srv: srv, svc: fake},
+	})
+	defer srv.Exit()
+
+	// An updating stream still accepts records
+	if err := srv.clientsReset(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if arn := srv.StreamARN(); arn != "arn:aws:kinesis:eu-west-1:123456789012:stream/test" {
+		t.Errorf("expected the ARN of the Kinesis stream, got %s", arn)
+	}
+
+	for _, r := range []string{"a", "b"} {
+		if err := srv.Send([]byte(r)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := srv.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := srv.SendNow(context.Background(), []byte("c")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Every record is a Kinesis record without the newline
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(fake.records))
+	}
+	for i, want := range []string{"a", "b", "c"} {
+		r := fake.records[i]
+		if string(r.Data) != want || aws.ToString(r.PartitionKey) != "key-"+want {
+			t.Errorf("expected the record %q with the key key-%s, got %q %s", want, want, r.Data, aws.ToString(r.PartitionKey))
+		}
+	}
+}
+
+func TestKinesisAPI(t *testing.T) {
+	fake := &fakeKinesis{status: ktypes.StreamStatusActive, reject: "throttled"}
+	srv := newTestServer(1)
+	api := &kinesisAPI{srv: srv, svc: fake}
+
+	// The records throttled by Kinesis are throttled for the clients
+	out, err := api.PutRecordBatch(context.Background(), &firehose.PutRecordBatchInput{
+		DeliveryStreamName: aws.String("test"),
+		Records:            []types.Record{{Data: []byte("sent")}, {Data: []byte("throttled")}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if *out.FailedPutCount != 1 || out.RequestResponses[0].ErrorCode != nil || !isThrottled(out.RequestResponses) {
+		t.Errorf("expected the second record throttled, got %+v", out)
+	}
+
+	// The murmur3 hash of the record by default
+	if want := fmt.Sprintf("%02x", murmur3.Sum64([]byte("sent"))); aws.ToString(fake.records[0].PartitionKey) != want {
+		t.Errorf("expected the partition key %s, got %s", want, aws.ToString(fake.records[0].PartitionKey))
+	}
+
+	fake.missing = true
+	if _, err := api.DescribeDeliveryStream(context.Background(), &firehose.DescribeDeliveryStreamInput{DeliveryStreamName: aws.String("test")}); !errors.Is(classifyError(err), ErrStreamNotFound) {
+		t.Errorf("expected %s, got %v", ErrStreamNotFound, err)
+	}
+
+	for _, c := range []struct {
+		err  error
+		want error
+	}{
+		{&ktypes.ProvisionedThroughputExceededException{}, ErrThrottled},
+		{&ktypes.KMSThrottlingException{}, ErrThrottled},
+		{&ktypes.ResourceNotFoundException{}, ErrStreamNotFound},
+	} {
+		if err := classifyError(kinesisError(c.err)); !errors.Is(err, c.want) {
+			t.Errorf("%T: expected %s, got %v", c.err, c.want, err)
+		}
+	}
+	if !isErrorValidation(kinesisError(&ktypes.InvalidArgumentException{})) {
+		t.Errorf("expected InvalidArgumentException to be a validation error")
+	}
+}
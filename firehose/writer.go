@@ -0,0 +1,59 @@
+package firehosePool
+
+import (
+	"bytes"
+	"context"
+)
+
+// Writer is an io.Writer that sends to the pool every Write as one record,
+// or every line as one record when SplitLines is set
+type Writer struct {
+	srv        *Server
+	ctx        context.Context
+	SplitLines bool
+}
+
+// NewWriter creates a Writer for the pool, the context bounds the wait when
+// the buffer is full
+func NewWriter(ctx context.Context, srv *Server, splitLines bool) *Writer {
+	return &Writer{
+		srv:        srv,
+		ctx:        ctx,
+		SplitLines: splitLines,
+	}
+}
+
+// Write sends the bytes to the pool, they are copied so p can be reused.
+// The count includes only the lines that were sent before an error.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	if !w.SplitLines {
+		if err = w.send(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	for len(p) > 0 {
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+		}
+
+		// Empty lines are not sent
+		if len(line) > 1 || line[0] != '\n' {
+			if err = w.send(line); err != nil {
+				return n, err
+			}
+		}
+		n += len(line)
+		p = p[len(line):]
+	}
+
+	return n, nil
+}
+
+func (w *Writer) send(p []byte) error {
+	b := make([]byte, len(p))
+	copy(b, p)
+	return w.srv.SendWithContext(w.ctx, b)
+}
@@ -0,0 +1,29 @@
+package firehosePool
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	srv := newTestServer(2)
+	w := NewWriter(context.Background(), srv, true)
+
+	n, err := w.Write([]byte("first\n\nsecond"))
+	if err != nil || n != 13 {
+		t.Fatalf("expected 13 bytes written, got %d: %v", n, err)
+	}
+	if l := len(srv.C); l != 2 {
+		t.Fatalf("expected 2 records, got %d", l)
+	}
+	if r := string((<-srv.C).([]byte)); r != "first\n" {
+		t.Errorf("unexpected record %q", r)
+	}
+
+	srv.cfg.MaxBufferedBytes = 8
+	srv.cfg.BufferFullError = true
+	n, err = w.Write([]byte("third\n"))
+	if err != ErrBufferFull || n != 0 {
+		t.Errorf("expected %s and 0 bytes, got %v and %d", ErrBufferFull, err, n)
+	}
+}
@@ -1,12 +1,17 @@
 package kinesisPool
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"strconv"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/aws/smithy-go/middleware"
 	"github.com/spaolacci/murmur3"
 )
 
@@ -28,6 +33,62 @@ func RandStringRunes(n int) []byte {
 	return b
 }
 
+// capturePutRecords returns a client that keeps the input of PutRecords and
+// accepts all the records without calling AWS
+func capturePutRecords(in **kinesis.PutRecordsInput) *kinesis.Client {
+	capture := middleware.InitializeMiddlewareFunc("capture", func(ctx context.Context, i middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		*in = i.Parameters.(*kinesis.PutRecordsInput)
+		return middleware.InitializeOutput{Result: &kinesis.PutRecordsOutput{
+			FailedRecordCount: aws.Int32(0),
+			Records:           make([]types.PutRecordsResultEntry, len((*in).Records)),
+		}}, middleware.Metadata{}, nil
+	})
+	return kinesis.New(kinesis.Options{
+		Region: "eu-west-1",
+		APIOptions: []func(*middleware.Stack) error{func(s *middleware.Stack) error {
+			return s.Initialize.Add(capture, middleware.Before)
+		}},
+	})
+}
+
+func TestPartitionKey(t *testing.T) {
+	var in *kinesis.PutRecordsInput
+	srv := &Server{
+		cfg: Config{
+			StreamName:   "test",
+			PartitionKey: func(b []byte) string { return "key-" + string(b[:1]) },
+		},
+		awsSvc: capturePutRecords(&in),
+	}
+	clt := &Client{srv: srv, t: time.NewTimer(time.Minute)}
+
+	for _, r := range []string{"a\n", "b\n"} {
+		b := pool.Get()
+		b.WriteString(r)
+		clt.batch = append(clt.batch, b)
+	}
+	clt.flush()
+
+	if in == nil || len(in.Records) != 2 {
+		t.Fatalf("expected 2 records in PutRecords, got %v", in)
+	}
+	for i, want := range []string{"key-a", "key-b"} {
+		if got := aws.ToString(in.Records[i].PartitionKey); got != want {
+			t.Errorf("record %d: expected the partition key %s, got %s", i, want, got)
+		}
+	}
+
+	// Without the option it's the hash of the record
+	srv.cfg.PartitionKey = nil
+	b := pool.Get()
+	b.WriteString("a\n")
+	clt.batch = append(clt.batch, b)
+	clt.flush()
+	if want := fmt.Sprintf("%02x", murmur3.Sum64([]byte("a\n"))); aws.ToString(in.Records[0].PartitionKey) != want {
+		t.Errorf("expected the murmur3 partition key %s, got %s", want, aws.ToString(in.Records[0].PartitionKey))
+	}
+}
+
 func BenchmarkMurmur3Size128(b *testing.B) {
 	b.ReportAllocs()
 	for n := 0; n < b.N; n++ {
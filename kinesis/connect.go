@@ -1,12 +1,13 @@
 package kinesisPool
 
 import (
+	"context"
 	"log"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
 )
 
 const (
@@ -61,32 +62,37 @@ func (srv *Server) clientsReset() (err error) {
 	if srv.errors == 0 && srv.lastConnection.Add(limitIntervalConnection).Before(time.Now()) {
 		log.Printf("Kinesis Reload config to the stream %s", srv.cfg.StreamName)
 
-		var sess *session.Session
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		defer cancel()
 
+		opts := []func(*config.LoadOptions) error{
+			config.WithRegion(srv.cfg.Region),
+		}
 		if srv.cfg.Profile != "" {
-			sess, err = session.NewSessionWithOptions(session.Options{
-				Profile:           srv.cfg.Profile,
-				SharedConfigState: session.SharedConfigEnable,
-			})
-		} else {
-			sess, err = session.NewSession()
+			opts = append(opts, config.WithSharedConfigProfile(srv.cfg.Profile))
 		}
 
+		var awsCfg aws.Config
+		awsCfg, err = config.LoadDefaultConfig(ctx, opts...)
 		if err != nil {
-			log.Printf("Kinesis ERROR: session: %s", err)
+			log.Printf("Kinesis ERROR: config: %s", err)
 
 			srv.errors++
 			srv.lastError = time.Now()
 			return err
 		}
 
-		srv.awsSvc = kinesis.New(sess, &aws.Config{Region: aws.String(srv.cfg.Region)})
+		srv.awsSvc = kinesis.NewFromConfig(awsCfg, func(o *kinesis.Options) {
+			if srv.cfg.Endpoint != "" {
+				o.BaseEndpoint = aws.String(srv.cfg.Endpoint)
+			}
+		})
 		stream := &kinesis.DescribeStreamInput{
-			StreamName: &srv.cfg.StreamName,
+			StreamName: aws.String(srv.cfg.StreamName),
 		}
 
 		var l *kinesis.DescribeStreamOutput
-		l, err = srv.awsSvc.DescribeStream(stream)
+		l, err = srv.awsSvc.DescribeStream(ctx, stream)
 		if err != nil {
 			log.Printf("Kinesis ERROR: describe stream: %s", err)
 
@@ -98,7 +104,7 @@ func (srv *Server) clientsReset() (err error) {
 		log.Printf("Kinesis Connected to %s (%s) status %s",
 			*l.StreamDescription.StreamName,
 			*l.StreamDescription.StreamARN,
-			*l.StreamDescription.StreamStatus)
+			l.StreamDescription.StreamStatus)
 
 		srv.lastConnection = time.Now()
 		srv.errors = 0
@@ -115,14 +121,14 @@ func (srv *Server) clientsReset() (err error) {
 		return nil
 	}
 
-	// If the config define lower number than the active clients remove the difference
+	// If the config define lower number than the active clients remove the
+	// newest ones, the slice is truncated once they were told to exit
 	if currClients > srv.cliDesired {
-		toExit := currClients - srv.cliDesired
-		for i := 0; i < toExit; i++ {
-			go srv.clients[0].Exit() // Don't block waiting for the client to flush
-			srv.clients[0] = nil
-			srv.clients = srv.clients[1:]
+		for i, c := range srv.clients[srv.cliDesired:] {
+			go c.Exit() // Don't block waiting for the client to flush
+			srv.clients[srv.cliDesired+i] = nil
 		}
+		srv.clients = srv.clients[:srv.cliDesired]
 	} else {
 		// If the config define higher number than the active clients start new clients
 		for i := currClients; i < srv.cliDesired; i++ {
@@ -5,7 +5,7 @@ import (
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
 	"github.com/gabrielperezs/monad"
 )
 
@@ -38,6 +38,11 @@ type Config struct {
 	StreamName string // Kinesis/Kinesis stream name
 	Region     string // AWS region
 	Profile    string // AWS Profile name
+	Endpoint   string // AWS endpoint, e.g. http://localhost:4566 for LocalStack
+
+	// PartitionKey returns the partition key of each Kinesis record, by default
+	// it's the murmur3 hash of the record data
+	PartitionKey func(b []byte) string
 }
 
 type Server struct {
@@ -54,7 +59,7 @@ type Server struct {
 	chDone   chan bool
 	exiting  bool
 
-	awsSvc         *kinesis.Kinesis
+	awsSvc         *kinesis.Client
 	lastConnection time.Time
 	lastError      time.Time
 	errors         int64